@@ -18,12 +18,47 @@ import "cloud.google.com/go/firestore"
 
 // A Client provides access to Firestore via the Calcifer ODM.
 type Client struct {
-	fs *firestore.Client
+	fs            *firestore.Client
+	unknownFields UnknownFieldPolicy
+	migrations    MigrationPolicy
 }
 
 // NewClient creates a new Calcifier client that uses the given Firestore client.
-func NewClient(fs *firestore.Client) *Client {
-	return &Client{fs: fs}
+func NewClient(fs *firestore.Client, opts ...ClientOption) *Client {
+	c := &Client{fs: fs}
+	for _, opt := range opts {
+		opt.applyClient(c)
+	}
+	return c
+}
+
+// A ClientOption configures a Client.
+type ClientOption interface {
+	applyClient(*Client)
+}
+
+// An UnknownFieldPolicy is a ClientOption that determines what happens when a
+// document read by the client has a field that matches no field of the model.
+// Whatever the policy, a struct with a map[string]interface{} field tagged
+// `calcifer:",remain"` captures such fields in that map, and writes them back
+// when it is stored.
+type UnknownFieldPolicy int
+
+const (
+	// RejectUnknownFields makes reads fail on unknown fields. It is the default.
+	RejectUnknownFields UnknownFieldPolicy = iota
+	// IgnoreUnknownFields makes reads drop unknown fields.
+	IgnoreUnknownFields
+)
+
+func (p UnknownFieldPolicy) applyClient(c *Client) { c.unknownFields = p }
+
+// An UnknownFieldPolicer is a model that sets its own UnknownFieldPolicy,
+// overriding that of the client for the documents read into it, including the
+// structs nested in them. The documents of its reference fields are read with
+// the policies of their own models.
+type UnknownFieldPolicer interface {
+	UnknownFieldPolicy() UnknownFieldPolicy
 }
 
 func (c *Client) Collection(path string) *CollectionRef {
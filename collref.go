@@ -15,6 +15,7 @@
 package calcifer
 
 import (
+	"context"
 	"crypto/rand"
 	"fmt"
 
@@ -41,6 +42,16 @@ func (c *CollectionRef) NewDoc() *DocumentRef {
 	return c.Doc(uniqueID())
 }
 
+// Add creates a document with a uniquely generated ID in the collection, and writes
+// m to it as with DocumentRef.Create.
+func (c *CollectionRef) Add(ctx context.Context, m MutableModel, opts ...CreateOption) (*DocumentRef, error) {
+	d := c.NewDoc()
+	if err := d.Create(ctx, m, opts...); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
 const alphanum = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
 
 func uniqueID() string {
@@ -0,0 +1,60 @@
+// Copyright 2022 Radiopaper Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calcifer
+
+import (
+	"fmt"
+	"reflect"
+)
+
+var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+
+// A computeFunc returns the value of a computed field of the struct v; see the
+// package documentation.
+type computeFunc func(v reflect.Value) (reflect.Value, error)
+
+// computeMethod returns the computeFunc of the computed field f of struct type t.
+func computeMethod(t reflect.Type, f field) (computeFunc, error) {
+	name := "Compute" + t.FieldByIndex(f.Index).Name
+	m, ok := t.MethodByName(name)
+	byPtr := false
+	if !ok {
+		m, ok = reflect.PointerTo(t).MethodByName(name)
+		byPtr = true
+	}
+	if !ok {
+		return nil, fmt.Errorf("computed field has no method %s", name)
+	}
+	mt := m.Type // the receiver is the first argument
+	if mt.NumIn() != 1 || mt.NumOut() < 1 || mt.NumOut() > 2 ||
+		!mt.Out(0).AssignableTo(f.Type) || (mt.NumOut() == 2 && mt.Out(1) != typeOfError) {
+		return nil, fmt.Errorf("method %s must take no arguments and return %s, optionally with an error", name, f.Type)
+	}
+	return func(v reflect.Value) (reflect.Value, error) {
+		if byPtr {
+			if !v.CanAddr() {
+				c := reflect.New(t).Elem()
+				c.Set(v)
+				v = c
+			}
+			v = v.Addr()
+		}
+		out := m.Func.Call([]reflect.Value{v})
+		if len(out) == 2 && !out[1].IsNil() {
+			return reflect.Value{}, out[1].Interface().(error)
+		}
+		return out[0], nil
+	}, nil
+}
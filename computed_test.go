@@ -0,0 +1,121 @@
+// Copyright 2022 Radiopaper Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calcifer
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type span struct {
+	Start time.Time `calcifer:"start"`
+	End   time.Time `calcifer:"end"`
+}
+
+type meeting struct {
+	Model
+	span
+	Title           string   `calcifer:"title"`
+	Attendees       []string `calcifer:"attendees"`
+	DurationMinutes int      `calcifer:"duration_minutes,computed"`
+	Slug            string   `calcifer:"slug,computed"`
+	AttendeeCount   int64    `calcifer:"attendee_count,computed"`
+}
+
+func (s span) ComputeDurationMinutes() (int, error) {
+	if s.End.Before(s.Start) {
+		return 0, errors.New("meeting ends before it starts")
+	}
+	return int(s.End.Sub(s.Start).Minutes()), nil
+}
+
+func (s span) ComputeCount() int {
+	return 2
+}
+
+func (m *meeting) ComputeSlug() string {
+	return strings.ReplaceAll(strings.ToLower(m.Title), " ", "-")
+}
+
+func (m meeting) ComputeAttendeeCount() int64 {
+	return int64(len(m.Attendees))
+}
+
+func TestComputedFields(t *testing.T) {
+	start := time.Date(2022, time.May, 4, 10, 0, 0, 0, time.UTC)
+	m := meeting{
+		span:      span{Start: start, End: start.Add(90 * time.Minute)},
+		Title:     "Weekly Sync",
+		Attendees: []string{"dave", "mary"},
+		Slug:      "stale",
+	}
+	// By value, so that ComputeSlug is called on a copy.
+	i, err := modelToDoc(m)
+	assert.NoError(t, err)
+	d := i.(map[string]interface{})
+	assert.Equal(t, int64(90), d["duration_minutes"])
+	assert.Equal(t, "weekly-sync", d["slug"])
+	assert.Equal(t, int64(2), d["attendee_count"])
+	assert.Equal(t, "stale", m.Slug)
+
+	// Stored values are ignored on read.
+	d["slug"] = "stale"
+	delete(d, "attendee_count")
+	var m2 meeting
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&m2), d))
+	assert.Equal(t, 90, m2.DurationMinutes)
+	assert.Equal(t, "weekly-sync", m2.Slug)
+	assert.Equal(t, int64(2), m2.AttendeeCount)
+
+	m.End = start.Add(-time.Minute)
+	_, err = modelToDoc(&m)
+	var ee *EncodeError
+	if assert.ErrorAs(t, err, &ee) {
+		assert.Equal(t, "duration_minutes", ee.Field)
+	}
+
+	_, err = modelUpdates(m, []Update{{Path: "slug", Value: "x"}})
+	assert.ErrorContains(t, err, "computed")
+}
+
+func TestComputedFieldValidation(t *testing.T) {
+	type testModel struct {
+		Model
+		Missing int       `calcifer:"missing,computed"`
+		Start   time.Time `calcifer:"start,computed,serverTimestamp"`
+		Wrong   string    `calcifer:"wrong,computed"`
+	}
+	err := RegisterModel(testModel{})
+	var mte *ModelTypeError
+	if assert.ErrorAs(t, err, &mte) {
+		assert.Len(t, mte.Problems, 3)
+		assert.ErrorContains(t, err, "computed field has no method ComputeMissing")
+		assert.ErrorContains(t, err, "computed field cannot be a reference or a serverTimestamp")
+	}
+
+	// ComputeCount is promoted from span, but returns the wrong type.
+	type wrongType struct {
+		Model
+		span
+		Count string `calcifer:"count,computed"`
+	}
+	err = RegisterModel(wrongType{})
+	assert.ErrorContains(t, err, "method ComputeCount must take no arguments and return string")
+}
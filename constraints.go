@@ -0,0 +1,378 @@
+// Copyright 2022 Radiopaper Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calcifer
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"cloud.google.com/go/firestore"
+)
+
+// A Validator checks its own value before it is written to Firestore. Set and
+// Create call the Validate methods of models and of the values of their fields;
+// Update calls those of the values being written. Validate may return a
+// *ValidationError to report failures of particular fields.
+//
+// Fields may also be constrained by tag options, which are checked along with
+// the Validate methods; see the package documentation.
+type Validator interface {
+	Validate() error
+}
+
+var typeOfValidator = reflect.TypeOf((*Validator)(nil)).Elem()
+
+// constraints holds the constraints on the value of a field, set by its tag
+// options; see the package documentation.
+type constraints struct {
+	required bool
+	min, max *float64
+	maxLen   *int
+	oneOf    []string
+}
+
+// parse sets the constraint expressed by the tag option opt, reporting whether
+// opt is a constraint option.
+func (c *constraints) parse(opt string) (bool, error) {
+	name, arg, hasArg := strings.Cut(opt, "=")
+	switch name {
+	case "required":
+		if hasArg {
+			return true, fmt.Errorf("invalid tag option %q", opt)
+		}
+		c.required = true
+	case "min", "max":
+		f, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return true, fmt.Errorf("invalid tag option %q", opt)
+		}
+		if name == "min" {
+			c.min = &f
+		} else {
+			c.max = &f
+		}
+	case "maxlen":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 0 {
+			return true, fmt.Errorf("invalid tag option %q", opt)
+		}
+		c.maxLen = &n
+	case "oneof":
+		if arg == "" {
+			return true, fmt.Errorf("invalid tag option %q", opt)
+		}
+		c.oneOf = strings.Split(arg, "|")
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// checkModel checks that the model m satisfies the constraints of its fields and
+// its Validate methods, returning a *ValidationError if it does not.
+func checkModel(m ReadableModel) error {
+	c := &checker{}
+	c.value(reflect.ValueOf(m), "")
+	return c.result()
+}
+
+// checkSet checks the fields of the model m that a Set with options c writes:
+// only the merged fields for Merge, and for MergeAll all fields but those that
+// omitempty leaves out. It returns a *ValidationError if they fail.
+func checkSet(m ReadableModel, c *setConfig) error {
+	if len(c.merges) != 1 {
+		return checkModel(m)
+	}
+	ch := &checker{merging: true}
+	if c.merges[0].all {
+		ch.value(reflect.ValueOf(m), "")
+		return ch.result()
+	}
+	v := reflect.Indirect(reflect.ValueOf(m))
+	for _, p := range c.merges[0].paths {
+		_, target, err := resolvePath(v.Type(), p)
+		if err != nil {
+			return err
+		}
+		var value interface{}
+		if fv := valueAtPath(v, p); fv.IsValid() {
+			value = fv.Interface()
+		}
+		ch.update(target, p, value)
+	}
+	return ch.result()
+}
+
+// valueAtPath returns the value of the struct v at the calcifer field path path,
+// or the zero Value if a nil pointer or a missing map entry is on the way.
+func valueAtPath(v reflect.Value, path string) reflect.Value {
+	for _, name := range strings.Split(path, ".") {
+		for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+			if v.IsNil() {
+				return reflect.Value{}
+			}
+			v = v.Elem()
+		}
+		switch v.Kind() {
+		case reflect.Map:
+			v = v.MapIndex(reflect.ValueOf(name).Convert(v.Type().Key()))
+		case reflect.Struct:
+			fs, err := defaultFieldCache.fields(v.Type())
+			if err != nil {
+				return reflect.Value{}
+			}
+			f, ok := fs.byName(name)
+			if !ok {
+				return reflect.Value{}
+			}
+			v = v.FieldByIndex(f.Index)
+		default:
+			return reflect.Value{}
+		}
+		if !v.IsValid() {
+			return v
+		}
+	}
+	return v
+}
+
+// A checker collects the violations of constraints found in values.
+type checker struct {
+	violations []Violation
+	err        error // an error other than a violation
+	merging    bool  // whether fields left out by omitempty are not written
+}
+
+func (c *checker) result() error {
+	if c.err != nil {
+		return c.err
+	}
+	if len(c.violations) > 0 {
+		return &ValidationError{Violations: c.violations}
+	}
+	return nil
+}
+
+func (c *checker) add(path, constraint, format string, args ...interface{}) {
+	c.violations = append(c.violations, Violation{Field: path, Constraint: constraint, Message: fmt.Sprintf(format, args...)})
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// value checks the constraints of the fields of the structs within v, and calls
+// the Validate methods of v and the values within it. path is the field path of v.
+func (c *checker) value(v reflect.Value, path string) {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if !v.IsNil() {
+			c.value(v.Elem(), path)
+		}
+		return
+	case reflect.Struct:
+		if !isLeafType(v.Type()) {
+			c.structValue(v, path)
+		}
+	case reflect.Slice:
+		if mayContainValidation(v.Type().Elem()) {
+			for i := 0; i < v.Len(); i++ {
+				c.value(v.Index(i), joinPath(path, strconv.Itoa(i)))
+			}
+		}
+	case reflect.Map:
+		if mayContainValidation(v.Type().Elem()) {
+			keys := v.MapKeys()
+			sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+			for _, k := range keys {
+				c.value(v.MapIndex(k), joinPath(path, k.String()))
+			}
+		}
+	}
+	c.callValidate(v, path)
+}
+
+// mayContainValidation reports whether values of type t may hold structs, whose
+// fields may have constraints, or implement Validator.
+func mayContainValidation(t reflect.Type) bool {
+	if t.Implements(typeOfValidator) || reflect.PointerTo(t).Implements(typeOfValidator) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Pointer, reflect.Slice, reflect.Map:
+		return mayContainValidation(t.Elem())
+	case reflect.Struct:
+		return !isLeafType(t)
+	case reflect.Interface:
+		return true
+	}
+	return false
+}
+
+func (c *checker) structValue(v reflect.Value, path string) {
+	fs, err := defaultFieldCache.fields(v.Type())
+	if err != nil {
+		c.err = err
+		return
+	}
+	for _, f := range fs {
+		if f.TagOptions.remain || f.TagOptions.readonly {
+			continue
+		}
+		fv := v.FieldByIndex(f.Index)
+		if c.merging && f.TagOptions.omitEmpty && isEmptyValue(fv, f.TagOptions.reference != "") {
+			continue
+		}
+		fpath := joinPath(path, f.Name)
+		c.field(f, fv, fpath)
+		if f.TagOptions.reference == "" { // only the IDs of references are written
+			c.value(fv, fpath)
+		}
+	}
+}
+
+// field checks that the value v of field f satisfies the field's constraints.
+func (c *checker) field(f field, v reflect.Value, path string) {
+	cs := f.TagOptions.constraints
+	if cs.required && !usesServerTimestamp(f, v) && isEmptyValue(v, f.TagOptions.reference != "") {
+		c.add(path, "required", "is required")
+		return
+	}
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	if cs.min != nil || cs.max != nil {
+		if x, ok := numberValue(v); ok {
+			if cs.min != nil && x < *cs.min {
+				c.add(path, fmt.Sprintf("min=%v", *cs.min), "must be at least %v", *cs.min)
+			}
+			if cs.max != nil && x > *cs.max {
+				c.add(path, fmt.Sprintf("max=%v", *cs.max), "must be at most %v", *cs.max)
+			}
+		}
+	}
+	if cs.maxLen != nil {
+		constraint := fmt.Sprintf("maxlen=%d", *cs.maxLen)
+		switch v.Kind() {
+		case reflect.String:
+			if utf8.RuneCountInString(v.String()) > *cs.maxLen {
+				c.add(path, constraint, "must be at most %d characters long", *cs.maxLen)
+			}
+		case reflect.Slice, reflect.Map:
+			if v.Len() > *cs.maxLen {
+				c.add(path, constraint, "must have at most %d elements", *cs.maxLen)
+			}
+		}
+	}
+	if cs.oneOf != nil {
+		var s string
+		switch v.Kind() {
+		case reflect.String:
+			s = v.String()
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			s = strconv.FormatInt(v.Int(), 10)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			s = strconv.FormatUint(v.Uint(), 10)
+		default:
+			return
+		}
+		for _, o := range cs.oneOf {
+			if s == o {
+				return
+			}
+		}
+		c.add(path, "oneof="+strings.Join(cs.oneOf, "|"), "must be one of %s", strings.Join(cs.oneOf, ", "))
+	}
+}
+
+func numberValue(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
+
+// callValidate calls the Validate method of v, or of its address, if it has one.
+func (c *checker) callValidate(v reflect.Value, path string) {
+	var val Validator
+	switch {
+	case v.Type().Implements(typeOfValidator):
+		val = v.Interface().(Validator)
+	case v.CanAddr() && v.Addr().Type().Implements(typeOfValidator):
+		val = v.Addr().Interface().(Validator)
+	case reflect.PointerTo(v.Type()).Implements(typeOfValidator):
+		cp := reflect.New(v.Type())
+		cp.Elem().Set(v)
+		val = cp.Interface().(Validator)
+	default:
+		return
+	}
+	err := val.Validate()
+	if err == nil {
+		return
+	}
+	var ve *ValidationError
+	if errors.As(err, &ve) {
+		for _, vi := range ve.Violations {
+			vi.Field = joinPath(path, vi.Field)
+			c.violations = append(c.violations, vi)
+		}
+		return
+	}
+	c.violations = append(c.violations, Violation{Field: path, Constraint: "Validate", Message: err.Error()})
+}
+
+// update checks that the value of an Update of the field addressed by target
+// satisfies the field's constraints.
+func (c *checker) update(target pathTarget, path string, value interface{}) {
+	if value == firestore.Delete {
+		if target.field != nil && target.field.TagOptions.constraints.required {
+			c.add(path, "required", "is required")
+		}
+		return
+	}
+	if value == nil {
+		if target.field != nil {
+			c.field(*target.field, reflect.ValueOf(&value).Elem(), path)
+		}
+		return
+	}
+	if isFirestoreSentinel(value) {
+		return
+	}
+	v := reflect.ValueOf(value)
+	if target.field != nil {
+		c.field(*target.field, v, path)
+	}
+	if target.reference == "" {
+		c.value(v, path)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2022 Radiopaper Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calcifer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/stretchr/testify/assert"
+)
+
+type pet struct {
+	Name    string `calcifer:"name,required,maxlen=5"`
+	Species string `calcifer:"species,oneof=cat|dog"`
+}
+
+type owner struct {
+	Model
+	Name    string         `calcifer:"name,required"`
+	Age     int            `calcifer:"age,min=0,max=150"`
+	Score   *float64       `calcifer:"score,min=0.5"`
+	Level   int            `calcifer:"level,oneof=1|2|3"`
+	Tags    []string       `calcifer:"tags,maxlen=2"`
+	Pets    []pet          `calcifer:"pets"`
+	Best    *pet           `calcifer:"best"`
+	ByName  map[string]pet `calcifer:"by_name"`
+	Friend  *owner         `calcifer:"friend,ref:owners,required"`
+	Joined  time.Time      `calcifer:"joined,required,serverTimestamp"`
+	Retired bool           `calcifer:"retired"`
+}
+
+func (o *owner) Validate() error {
+	if o.Retired && o.Age < 60 {
+		return errors.New("too young to retire")
+	}
+	return nil
+}
+
+func TestCheckModel(t *testing.T) {
+	ok := owner{
+		Name:   "Dave",
+		Age:    42,
+		Level:  2,
+		Pets:   []pet{{Name: "Rex", Species: "dog"}},
+		Friend: &owner{Model: Model{ID: "2"}},
+	}
+	assert.NoError(t, checkModel(ok))
+	assert.NoError(t, checkModel(&ok))
+
+	low := 0.1
+	bad := owner{
+		Age:     -1,
+		Score:   &low,
+		Level:   4,
+		Tags:    []string{"a", "b", "c"},
+		Pets:    []pet{{Name: "Rex", Species: "dog"}, {Name: "Mittens", Species: "cow"}},
+		Best:    &pet{Species: "cat"},
+		ByName:  map[string]pet{"rex": {Name: "Rex", Species: "t-rex"}},
+		Friend:  &owner{},
+		Retired: true,
+	}
+	err := checkModel(bad)
+	var ve *ValidationError
+	if !assert.ErrorAs(t, err, &ve) {
+		return
+	}
+	assert.Equal(t, []Violation{
+		{Field: "name", Constraint: "required", Message: "is required"},
+		{Field: "age", Constraint: "min=0", Message: "must be at least 0"},
+		{Field: "score", Constraint: "min=0.5", Message: "must be at least 0.5"},
+		{Field: "level", Constraint: "oneof=1|2|3", Message: "must be one of 1, 2, 3"},
+		{Field: "tags", Constraint: "maxlen=2", Message: "must have at most 2 elements"},
+		{Field: "pets.1.name", Constraint: "maxlen=5", Message: "must be at most 5 characters long"},
+		{Field: "pets.1.species", Constraint: "oneof=cat|dog", Message: "must be one of cat, dog"},
+		{Field: "best.name", Constraint: "required", Message: "is required"},
+		{Field: "by_name.rex.species", Constraint: "oneof=cat|dog", Message: "must be one of cat, dog"},
+		{Field: "friend", Constraint: "required", Message: "is required"},
+		{Field: "", Constraint: "Validate", Message: "too young to retire"},
+	}, ve.Violations)
+	assert.Contains(t, err.Error(), "name is required; age must be at least 0;")
+}
+
+func TestCheckUpdates(t *testing.T) {
+	_, err := modelUpdates(owner{}, []Update{
+		{Path: "name", Value: "Dave"},
+		{Path: "age", Value: 200},
+		{Path: "joined", Value: firestore.ServerTimestamp},
+		{Path: "friend", Value: firestore.Delete},
+		{Path: "pets", Value: []pet{{Species: "cat"}}},
+		{Path: "by_name.rex", Value: pet{Name: "Rex", Species: "dog"}},
+		{Path: "best", Value: nil},
+		{Path: "tags", Value: []string{"a"}},
+	})
+	var ve *ValidationError
+	if !assert.ErrorAs(t, err, &ve) {
+		return
+	}
+	assert.Equal(t, []Violation{
+		{Field: "age", Constraint: "max=150", Message: "must be at most 150"},
+		{Field: "friend", Constraint: "required", Message: "is required"},
+		{Field: "pets.0.name", Constraint: "required", Message: "is required"},
+	}, ve.Violations)
+
+	_, err = modelUpdates(owner{}, []Update{{Path: "name", Value: ""}})
+	assert.ErrorAs(t, err, &ve)
+}
+
+func TestCheckSet(t *testing.T) {
+	// Only the merged fields are checked: name and friend are required, but
+	// not written.
+	partial := &owner{Age: 30, Best: &pet{Name: "Rex"}, ByName: map[string]pet{"rex": {Name: "Rex", Species: "dog"}}}
+	assert.NoError(t, checkSet(partial, newSetConfig([]SetOption{Merge("age", "best.name", "by_name.rex")})))
+	assert.Error(t, checkSet(partial, newSetConfig(nil)))
+
+	var ve *ValidationError
+	err := checkSet(partial, newSetConfig([]SetOption{Merge("age", "name", "best.species")}))
+	if assert.ErrorAs(t, err, &ve) {
+		assert.Equal(t, []Violation{
+			{Field: "name", Constraint: "required", Message: "is required"},
+			{Field: "best.species", Constraint: "oneof=cat|dog", Message: "must be one of cat, dog"},
+		}, ve.Violations)
+	}
+	err = checkSet(&owner{Age: 200}, newSetConfig([]SetOption{Merge("age")}))
+	assert.ErrorAs(t, err, &ve)
+	assert.Error(t, checkSet(partial, newSetConfig([]SetOption{Merge("nope")})))
+
+	// MergeAll skips the fields that omitempty leaves out.
+	type draft struct {
+		Model
+		Title string `calcifer:"title,required,omitempty"`
+		Body  string `calcifer:"body,required"`
+	}
+	err = checkSet(&draft{}, newSetConfig([]SetOption{MergeAll}))
+	if assert.ErrorAs(t, err, &ve) {
+		assert.Equal(t, []Violation{{Field: "body", Constraint: "required", Message: "is required"}}, ve.Violations)
+	}
+	assert.NoError(t, checkSet(&draft{Body: "text"}, newSetConfig([]SetOption{MergeAll})))
+	assert.Error(t, checkSet(&draft{Body: "text"}, newSetConfig(nil)))
+}
+
+func TestConstraintValidation(t *testing.T) {
+	type badConstraints struct {
+		Name  string   `calcifer:"name,min=1"`
+		Age   int      `calcifer:"age,maxlen=3"`
+		Level int      `calcifer:"level,oneof=low|high"`
+		Tags  []string `calcifer:"tags,oneof=a|b"`
+		Max   int      `calcifer:"max,max=ten"`
+	}
+	err := RegisterModel(struct {
+		Model
+		badConstraints
+	}{})
+	var mte *ModelTypeError
+	if !assert.ErrorAs(t, err, &mte) {
+		return
+	}
+	assert.Len(t, mte.Problems, 6)
+	assert.Contains(t, err.Error(), "min and max constraints apply to numbers")
+	assert.Contains(t, err.Error(), "maxlen constraint applies to strings")
+	assert.Contains(t, err.Error(), `oneof value "low" is not an integer`)
+	assert.Contains(t, err.Error(), "oneof constraint applies to strings and integers")
+	assert.Contains(t, err.Error(), `invalid tag option "max=ten"`)
+}
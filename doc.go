@@ -0,0 +1,96 @@
+// Copyright 2022 Radiopaper Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package calcifer maps Go structs embedding Model to Firestore documents.
+
+# Struct tags
+
+The fields of a model are stored as document fields named by their
+`calcifer:"..."` struct tags, or by their Go names if they have none. The tag
+`calcifer:"-"` leaves a field out. A tag is a name followed by comma-separated
+options:
+
+	type Event struct {
+		Model
+		Title     string    `calcifer:"title,required,maxlen=80"`
+		Location  *Location `calcifer:"location,ref:locations,onmissing=nil"`
+		Attendees []User    `calcifer:"attendees,ref:users,omitempty"`
+		Start     time.Time `calcifer:"start,serverTimestamp"`
+	}
+
+Documents are read into the field whose name matches a document field, or,
+failing that, an alias of the field, or its name in any case.
+
+The options that control how a field is stored are:
+
+	omitempty               an empty value is not stored; a reference is empty if it has no ID
+	alias:NAME              the field is also read from document fields called NAME
+	remain                  a map[string]interface{} field holds the document fields that match no other field
+	serverTimestamp         a zero time.Time is written as the time of the write
+	serverTimestamp:always  the time.Time is always written as the time of the write
+	readonly                the field is read but never written, leaving the stored value
+	writeonly               the field is written but never read
+	computed                the field is set by a method of its struct; see below
+
+Server timestamps cannot be stored in arrays, so serverTimestamp fields cannot
+be in structs held by slices. Set and Update reject paths to readonly fields,
+and write other fields of structs with readonly fields one by one.
+
+A field tagged "ref:COLLECTION" refers to documents of that collection. It is a
+pointer, slice or string-keyed map of models, or pointers to models, of which
+only the IDs are stored. Reads expand references into the models they refer
+to. The options of reference fields are:
+
+	as=id         the reference is stored as the document ID; the default
+	as=path       the reference is stored as the document's path, such as "users/1"
+	as=reference  the reference is stored as a Firestore document reference
+	onmissing=P   references to documents that don't exist are handled by policy P;
+	              one of "error", "keep-id", "nil" and "drop", as for MissingPolicy
+
+A computed field holds a value derived from the rest of its struct by a method
+named Compute followed by the Go name of the field, which takes no arguments and
+returns the value, optionally with an error:
+
+	type Event struct {
+		Model
+		Start           time.Time `calcifer:"start"`
+		End             time.Time `calcifer:"end"`
+		DurationMinutes int       `calcifer:"duration_minutes,computed"`
+	}
+
+	func (e Event) ComputeDurationMinutes() int {
+		return int(e.End.Sub(e.Start).Minutes())
+	}
+
+When the struct is written, the value returned by the method is stored, whatever
+the value of the Go field, so that documents can be queried by it. When the
+struct is read, the stored value is ignored, and the Go field is set by calling
+the method once the other fields are set. Update does not recompute computed
+fields, and computed fields cannot be updated.
+
+Values may be constrained by these options, which are checked with the Validate
+methods of models and of the values of their fields, before they are written:
+
+	required    the value must not be empty, as defined for omitempty
+	min=N       a number must be at least N
+	max=N       a number must be at most N
+	maxlen=N    a string must have at most N characters, and a slice or map at most N elements
+	oneof=A|B   a string or integer must be one of the values separated by "|"
+
+Constraints other than required are not checked for nil pointers.
+
+RegisterModel reports the fields whose tags don't apply to their types.
+*/
+package calcifer
@@ -17,208 +17,715 @@ package calcifer
 import (
 	"errors"
 	"fmt"
+	"math"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/firestore"
+	"google.golang.org/genproto/googleapis/type/latlng"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 var (
 	typeOfByteSlice          = reflect.TypeOf([]byte{})
 	typeOfGoTime             = reflect.TypeOf(time.Time{})
+	typeOfBool               = reflect.TypeOf(false)
+	typeOfString             = reflect.TypeOf("")
 	typeOfInt64              = reflect.TypeOf(int64(0))
 	typeOfUInt32             = reflect.TypeOf(uint32(0))
 	typeOfFloat64            = reflect.TypeOf(float64(0))
+	typeOfInterface          = reflect.TypeOf((*interface{})(nil)).Elem()
 	typeOfMapStringInterface = reflect.TypeOf(map[string]interface{}{})
+	typeOfLatLng             = reflect.TypeOf((*latlng.LatLng)(nil))
+	typeOfProtoTimestamp     = reflect.TypeOf((*timestamppb.Timestamp)(nil))
+	typeOfFirestoreDocRef    = reflect.TypeOf((*firestore.DocumentRef)(nil))
+	typeOfDocRef             = reflect.TypeOf((*DocumentRef)(nil))
 )
 
-func docToModel(m MutableModel, doc *firestore.DocumentSnapshot) error {
+// A decoder sets Go values from Firestore data.
+type decoder struct {
+	cli     *Client            // client of decoded *DocumentRef values; may be nil
+	unknown UnknownFieldPolicy // how to treat document fields that match no struct field
+}
+
+func (c *Client) docToModel(m MutableModel, doc *firestore.DocumentSnapshot) error {
+	_, err := c.decodeDoc(m, doc)
+	return err
+}
+
+// decodeDoc populates m from doc, after upgrading its data to the current
+// schema version of m's type. It returns the upgraded data if any migration
+// was applied, and nil otherwise.
+func (c *Client) decodeDoc(m MutableModel, doc *firestore.DocumentSnapshot) (map[string]interface{}, error) {
 	d := doc.Data()
 	v := reflect.ValueOf(m)
 	if v.Kind() != reflect.Ptr || v.IsNil() {
-		return errors.New("calcifer: nil or not a pointer")
+		return nil, errors.New("calcifer: nil or not a pointer")
 	}
-	if err := dataToValue(v, d); err != nil {
-		return err
+	migrated, err := migrate(v.Type().Elem(), d)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.modelDecoder(m).dataToValue(v, d); err != nil {
+		return nil, inDocument(err, doc.Ref.Path)
 	}
 	m.setID(doc.Ref.ID)
 	m.setCreateTime(doc.CreateTime)
 	m.setUpdateTime(doc.UpdateTime)
+	if !migrated {
+		return nil, nil
+	}
+	return d, nil
+}
+
+// modelDecoder returns the decoder of documents read into m, which applies the
+// UnknownFieldPolicy of m if it is an UnknownFieldPolicer, and else that of c.
+func (c *Client) modelDecoder(m MutableModel) *decoder {
+	dec := &decoder{cli: c, unknown: c.unknownFields}
+	if p, ok := m.(UnknownFieldPolicer); ok {
+		dec.unknown = p.UnknownFieldPolicy()
+	}
+	return dec
+}
+
+// A decoderFunc sets a value of a particular type from Firestore data.
+type decoderFunc func(dec *decoder, v reflect.Value, d interface{}) error
+
+var decoderCache sync.Map // from reflect.Type to decoderFunc
+
+// dataToValue sets v from the Firestore data d, returning a *DecodeError on failure.
+func (dec *decoder) dataToValue(v reflect.Value, d interface{}) error {
+	if err := typeDecoder(v.Type())(dec, v, d); err != nil {
+		return decodeErr(v.Type(), d, err)
+	}
 	return nil
 }
 
-func dataToValue(v reflect.Value, d interface{}) error {
-	typeErr := func() error {
-		return fmt.Errorf("calcifer: cannot set type %s to %s", v.Type(), reflect.TypeOf(d))
+// typeDecoder returns the cached decoderFunc for values of type t, building it
+// on first use.
+func typeDecoder(t reflect.Type) decoderFunc {
+	if fi, ok := decoderCache.Load(t); ok {
+		return fi.(decoderFunc)
 	}
 
-	// set nillable types to nil
-	if d == nil {
-		switch v.Kind() {
-		case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice:
-			v.Set(reflect.Zero(v.Type()))
+	// As in typeEncoder, an indirect func stands in for the decoder of a
+	// recursive type while it is being built.
+	var (
+		wg sync.WaitGroup
+		f  decoderFunc
+	)
+	wg.Add(1)
+	fi, loaded := decoderCache.LoadOrStore(t, decoderFunc(func(dec *decoder, v reflect.Value, d interface{}) error {
+		wg.Wait()
+		return f(dec, v, d)
+	}))
+	if loaded {
+		return fi.(decoderFunc)
+	}
+	f = newTypeDecoder(t)
+	wg.Done()
+	decoderCache.Store(t, f)
+	return f
+}
+
+func newTypeDecoder(t reflect.Type) decoderFunc {
+	var nillable bool
+	switch t.Kind() {
+	case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice:
+		nillable = true
+	}
+	unmarshals := isUnmarshalingType(t)
+	valueDec := newValueDecoder(t)
+	return func(dec *decoder, v reflect.Value, d interface{}) error {
+		// set nillable types to nil
+		if d == nil {
+			if nillable {
+				v.Set(reflect.Zero(t))
+			}
+			return nil
 		}
-		return nil
+
+		// let types that implement ValueUnmarshaler or TextUnmarshaler decode themselves
+		if unmarshals {
+			if ok, err := unmarshalValue(v, d); ok {
+				return err
+			}
+		}
+		return valueDec(dec, v, d)
 	}
+}
 
-	// dereference data pointers
-	dv := reflect.ValueOf(d)
-	if dv.Kind() == reflect.Ptr {
-		return dataToValue(v, dv.Elem().Interface())
+func typeErr(v reflect.Value, d interface{}) error {
+	return fmt.Errorf("calcifer: cannot set type %s to %s", v.Type(), reflect.TypeOf(d))
+}
+
+// newValueDecoder returns a decoder for type t that expects non-nil data.
+func newValueDecoder(t reflect.Type) decoderFunc {
+	// store any data in empty interfaces as-is
+	if t.Kind() == reflect.Interface && t.NumMethod() == 0 {
+		return emptyInterfaceDecoder
 	}
 
+	// convert Firestore's own value types, which are pointers
+	switch t {
+	case typeOfLatLng:
+		return latLngDecoder
+	case typeOfProtoTimestamp:
+		return protoTimestampDecoder
+	case typeOfFirestoreDocRef:
+		return firestoreDocRefDecoder
+	case typeOfDocRef:
+		return docRefDecoder
+	}
+
+	kindDec := newKindDecoder(t)
+	return func(dec *decoder, v reflect.Value, d interface{}) error {
+		// dereference data pointers
+		if dv := reflect.ValueOf(d); dv.Kind() == reflect.Ptr {
+			return dec.dataToValue(v, dv.Elem().Interface())
+		}
+		return kindDec(dec, v, d)
+	}
+}
+
+func newKindDecoder(t reflect.Type) decoderFunc {
 	// convert special types
-	switch v.Type() {
+	switch t {
 	case typeOfGoTime:
-		x, ok := d.(time.Time)
-		if !ok {
-			return typeErr()
-		}
-		v.Set(reflect.ValueOf(x))
-		return nil
+		return timeDecoder
 	case typeOfByteSlice:
-		x, ok := d.([]byte)
-		if !ok {
-			return typeErr()
-		}
-		v.SetBytes(x)
-		return nil
+		return byteSliceDecoder
 	}
 
 	// convert supported kinds
-	switch v.Kind() {
+	switch t.Kind() {
 	case reflect.Ptr:
+		return newPtrDecoder(t)
+	case reflect.Struct:
+		return newStructDecoder(t)
+	case reflect.Map:
+		return newMapDecoder(t)
+	case reflect.Slice:
+		return newSliceDecoder(t)
+	case reflect.Bool:
+		return boolDecoder
+	case reflect.String:
+		return stringDecoder
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return intDecoder
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return uintDecoder
+	case reflect.Float32, reflect.Float64:
+		return floatDecoder
+	}
+	err := fmt.Errorf("calcifer: cannot set type %s", t)
+	return func(*decoder, reflect.Value, interface{}) error { return err }
+}
+
+func emptyInterfaceDecoder(_ *decoder, v reflect.Value, d interface{}) error {
+	v.Set(reflect.ValueOf(d))
+	return nil
+}
+
+func latLngDecoder(_ *decoder, v reflect.Value, d interface{}) error {
+	x, ok := d.(*latlng.LatLng)
+	if !ok {
+		return typeErr(v, d)
+	}
+	v.Set(reflect.ValueOf(x))
+	return nil
+}
+
+func protoTimestampDecoder(_ *decoder, v reflect.Value, d interface{}) error {
+	switch x := d.(type) {
+	case time.Time:
+		v.Set(reflect.ValueOf(timestamppb.New(x)))
+	case *timestamppb.Timestamp:
+		v.Set(reflect.ValueOf(x))
+	default:
+		return typeErr(v, d)
+	}
+	return nil
+}
+
+func firestoreDocRefDecoder(_ *decoder, v reflect.Value, d interface{}) error {
+	x, ok := d.(*firestore.DocumentRef)
+	if !ok {
+		return typeErr(v, d)
+	}
+	v.Set(reflect.ValueOf(x))
+	return nil
+}
+
+func docRefDecoder(dec *decoder, v reflect.Value, d interface{}) error {
+	x, ok := d.(*firestore.DocumentRef)
+	if !ok {
+		return typeErr(v, d)
+	}
+	v.Set(reflect.ValueOf(&DocumentRef{DocumentRef: x, cli: dec.cli}))
+	return nil
+}
+
+func timeDecoder(_ *decoder, v reflect.Value, d interface{}) error {
+	x, ok := d.(time.Time)
+	if !ok {
+		return typeErr(v, d)
+	}
+	v.Set(reflect.ValueOf(x))
+	return nil
+}
+
+func byteSliceDecoder(_ *decoder, v reflect.Value, d interface{}) error {
+	x, ok := d.([]byte)
+	if !ok {
+		return typeErr(v, d)
+	}
+	v.SetBytes(x)
+	return nil
+}
+
+func newPtrDecoder(t reflect.Type) decoderFunc {
+	elemDec := typeDecoder(t.Elem())
+	return func(dec *decoder, v reflect.Value, d interface{}) error {
 		// If the pointer is nil, allocate a zero value.
 		if v.IsNil() {
-			v.Set(reflect.New(v.Type().Elem()))
-		}
-		return dataToValue(v.Elem(), d)
-	case reflect.Struct:
-		x, ok := d.(map[string]interface{})
-		if !ok {
-			return typeErr()
+			v.Set(reflect.New(t.Elem()))
 		}
-		return populateStruct(v, x)
-	case reflect.Map:
-		x, ok := d.(map[string]interface{})
-		if !ok {
-			return typeErr()
+		if err := elemDec(dec, v.Elem(), d); err != nil {
+			return decodeErr(t.Elem(), d, err)
 		}
-		return populateMap(v, x)
-	case reflect.Slice:
+		return nil
+	}
+}
+
+func newSliceDecoder(t reflect.Type) decoderFunc {
+	elemDec := typeDecoder(t.Elem())
+	return func(dec *decoder, v reflect.Value, d interface{}) error {
+		dv := reflect.ValueOf(d)
 		if dv.Kind() != reflect.Slice {
-			return typeErr()
+			return typeErr(v, d)
 		}
 		dlen := dv.Len()
 		vlen := v.Len()
 		if vlen < dlen {
-			v.Set(reflect.MakeSlice(v.Type(), dlen, dlen))
+			v.Set(reflect.MakeSlice(t, dlen, dlen))
 		} else {
 			v.SetLen(dlen)
 		}
 		for i := 0; i < dlen; i++ {
-			if err := dataToValue(v.Index(i), dv.Index(i).Interface()); err != nil {
-				return err
+			dd := dv.Index(i).Interface()
+			if err := elemDec(dec, v.Index(i), dd); err != nil {
+				return decodeErr(t.Elem(), dd, err).in(strconv.Itoa(i))
 			}
 		}
-	case reflect.Bool:
-		x, ok := d.(bool)
-		if !ok {
-			return typeErr()
+		return nil
+	}
+}
+
+func boolDecoder(_ *decoder, v reflect.Value, d interface{}) error {
+	x, ok := d.(bool)
+	if !ok {
+		return typeErr(v, d)
+	}
+	v.SetBool(x)
+	return nil
+}
+
+func stringDecoder(_ *decoder, v reflect.Value, d interface{}) error {
+	x, ok := d.(string)
+	if !ok {
+		return typeErr(v, d)
+	}
+	v.SetString(x)
+	return nil
+}
+
+func intDecoder(_ *decoder, v reflect.Value, d interface{}) error {
+	dv := reflect.ValueOf(d)
+	if !isNumber(dv) {
+		return typeErr(v, d)
+	}
+	i, err := numberToInt(dv, v.Type())
+	if err != nil {
+		return err
+	}
+	v.SetInt(i)
+	return nil
+}
+
+func uintDecoder(_ *decoder, v reflect.Value, d interface{}) error {
+	dv := reflect.ValueOf(d)
+	if !isNumber(dv) {
+		return typeErr(v, d)
+	}
+	u, err := numberToUint(dv, v.Type())
+	if err != nil {
+		return err
+	}
+	v.SetUint(u)
+	return nil
+}
+
+func floatDecoder(_ *decoder, v reflect.Value, d interface{}) error {
+	dv := reflect.ValueOf(d)
+	if !isNumber(dv) {
+		return typeErr(v, d)
+	}
+	f, err := numberToFloat(dv, v.Type())
+	if err != nil {
+		return err
+	}
+	v.SetFloat(f)
+	return nil
+}
+
+// dataMap returns the map value dv as a map[string]interface{}, which is how
+// Firestore represents maps, if its keys are strings.
+func dataMap(dv reflect.Value) (map[string]interface{}, bool) {
+	if x, ok := dv.Interface().(map[string]interface{}); ok {
+		return x, true
+	}
+	if dv.Kind() != reflect.Map || dv.Type().Key().Kind() != reflect.String {
+		return nil, false
+	}
+	x := make(map[string]interface{}, dv.Len())
+	iter := dv.MapRange()
+	for iter.Next() {
+		x[iter.Key().String()] = iter.Value().Interface()
+	}
+	return x, true
+}
+
+// maxExactFloat is the largest magnitude up to which every integer can be
+// represented exactly by a float64.
+const maxExactFloat = 1 << 53
+
+func isNumber(dv reflect.Value) bool {
+	switch dv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func overflowErr(x interface{}, t reflect.Type) error {
+	return fmt.Errorf("calcifer: value %v overflows type %s", x, t)
+}
+
+func precisionErr(x interface{}, t reflect.Type) error {
+	return fmt.Errorf("calcifer: value %v cannot be represented exactly by type %s", x, t)
+}
+
+// numberToInt converts the numeric value dv to a value of the signed integer type t,
+// failing if the conversion would lose information.
+func numberToInt(dv reflect.Value, t reflect.Type) (int64, error) {
+	var i int64
+	switch dv.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u := dv.Uint()
+		if u > math.MaxInt64 {
+			return 0, overflowErr(u, t)
 		}
-		v.SetBool(x)
-	case reflect.String:
-		x, ok := d.(string)
-		if !ok {
-			return typeErr()
+		i = int64(u)
+	case reflect.Float32, reflect.Float64:
+		f := dv.Float()
+		if f != math.Trunc(f) {
+			return 0, precisionErr(f, t)
 		}
-		v.SetString(x)
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		var i int64
-		switch x := d.(type) {
-		case int:
-			i = int64(x)
-		case int8:
-			i = int64(x)
-		case int16:
-			i = int64(x)
-		case int32:
-			i = int64(x)
-		case int64:
-			i = int64(x)
-		}
-		if v.OverflowInt(i) {
-			return fmt.Errorf("calcifer: value %v overflows type %s", i, v.Type())
-		}
-		v.SetInt(i)
-	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		var i uint64
-		switch x := d.(type) {
-		case uint:
-			i = uint64(x)
-		case uint8:
-			i = uint64(x)
-		case uint16:
-			i = uint64(x)
-		case uint32:
-			i = uint64(x)
-		case uint64:
-			i = uint64(x)
-		}
-		if v.OverflowUint(i) {
-			return fmt.Errorf("calcifer: value %v overflows type %s", i, v.Type())
-		}
-		v.SetUint(i)
+		if f < math.MinInt64 || f >= math.MaxInt64 {
+			return 0, overflowErr(f, t)
+		}
+		i = int64(f)
+	default:
+		i = dv.Int()
+	}
+	if reflect.Zero(t).OverflowInt(i) {
+		return 0, overflowErr(i, t)
+	}
+	return i, nil
+}
+
+// numberToUint converts the numeric value dv to a value of the unsigned integer type t,
+// failing if the conversion would lose information.
+func numberToUint(dv reflect.Value, t reflect.Type) (uint64, error) {
+	var u uint64
+	switch dv.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u = dv.Uint()
 	case reflect.Float32, reflect.Float64:
-		return errors.New("calcifer: float deserialization unimplemented")
+		f := dv.Float()
+		if f != math.Trunc(f) {
+			return 0, precisionErr(f, t)
+		}
+		if f < 0 || f >= math.MaxUint64 {
+			return 0, overflowErr(f, t)
+		}
+		u = uint64(f)
 	default:
-		return fmt.Errorf("calcifer: cannot set type %s", v.Type())
+		i := dv.Int()
+		if i < 0 {
+			return 0, overflowErr(i, t)
+		}
+		u = uint64(i)
 	}
-	return nil
+	if reflect.Zero(t).OverflowUint(u) {
+		return 0, overflowErr(u, t)
+	}
+	return u, nil
 }
 
-func populateStruct(v reflect.Value, d map[string]interface{}) error {
-	fs, err := defaultFieldCache.fields(v.Type())
-	if err != nil {
-		return err
+// numberToFloat converts the numeric value dv to a value of the floating-point type t,
+// failing if an integer is too large to be represented exactly.
+func numberToFloat(dv reflect.Value, t reflect.Type) (float64, error) {
+	var f float64
+	switch dv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		f = dv.Float()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u := dv.Uint()
+		if u > maxExactFloat {
+			return 0, precisionErr(u, t)
+		}
+		f = float64(u)
+	default:
+		i := dv.Int()
+		if i > maxExactFloat || i < -maxExactFloat {
+			return 0, precisionErr(i, t)
+		}
+		f = float64(i)
 	}
-OUTER:
+	if reflect.Zero(t).OverflowFloat(f) {
+		return 0, overflowErr(f, t)
+	}
+	return f, nil
+}
+
+// A fieldDecoder reads one field of a struct.
+type fieldDecoder struct {
+	field
+	dec     decoderFunc
+	compute computeFunc // nil unless the field is computed
+}
+
+// A structDecoder reads documents into structs of one type.
+type structDecoder struct {
+	fields  []fieldDecoder
+	names   map[string]int // index into fields by name
+	aliases map[string]int // index into fields by alias
+	remain  []int          // index of the remain field, if any
+	compute []int          // indexes into fields of the computed fields
+}
+
+func newStructDecoder(t reflect.Type) decoderFunc {
+	fs, err := defaultFieldCache.fields(t)
+	sd := &structDecoder{
+		names:   make(map[string]int, len(fs)),
+		aliases: make(map[string]int),
+	}
+	for _, f := range fs {
+		if f.TagOptions.remain {
+			sd.remain = f.Index
+			continue
+		}
+		fd := fieldDecoder{field: f, dec: typeDecoder(f.Type)}
+		if f.TagOptions.computed {
+			var cerr error
+			if fd.compute, cerr = computeMethod(t, f); cerr != nil && err == nil {
+				err = cerr
+			}
+			sd.compute = append(sd.compute, len(sd.fields))
+		}
+		sd.names[f.Name] = len(sd.fields)
+		for _, a := range f.TagOptions.aliases {
+			sd.aliases[a] = len(sd.fields)
+		}
+		sd.fields = append(sd.fields, fd)
+	}
+	return func(dec *decoder, v reflect.Value, d interface{}) error {
+		x, ok := dataMap(reflect.ValueOf(d))
+		if !ok {
+			return typeErr(v, d)
+		}
+		if err != nil {
+			return err
+		}
+		return sd.decode(dec, v, x)
+	}
+}
+
+// forDocField returns the field that the document field name is read into: the
+// field with that name, else the field with that alias, else the field whose name
+// matches it case-insensitively. It also returns the rank of the match, lower
+// ranks taking precedence: 0 for the name, then the aliases in tag order, then
+// any other case.
+func (sd *structDecoder) forDocField(name string) (f *fieldDecoder, rank int, ok bool) {
+	if i, ok := sd.names[name]; ok {
+		return &sd.fields[i], 0, true
+	}
+	if i, ok := sd.aliases[name]; ok {
+		f := &sd.fields[i]
+		for j, a := range f.TagOptions.aliases {
+			if a == name {
+				return f, 1 + j, true
+			}
+		}
+	}
+	b := []byte(name)
+	for i := range sd.fields {
+		if f := &sd.fields[i]; f.equalFold(f.nameBytes, b) {
+			return f, 1 + len(f.TagOptions.aliases), true
+		}
+	}
+	return nil, 0, false
+}
+
+// A docKey is a document field read into a struct field, and the rank of its match.
+type docKey struct {
+	name string
+	rank int
+}
+
+// precedes reports whether k takes precedence over l when both are read into
+// the same field: by rank, and then in lexical order.
+func (k docKey) precedes(l docKey) bool {
+	if k.rank != l.rank {
+		return k.rank < l.rank
+	}
+	return k.name < l.name
+}
+
+func (sd *structDecoder) decode(dec *decoder, v reflect.Value, d map[string]interface{}) error {
+	var remain reflect.Value
+	if sd.remain != nil {
+		remain = v.FieldByIndex(sd.remain)
+		remain.Set(reflect.Zero(remain.Type()))
+	}
+	// The document fields read into each field by other than its name, so that
+	// of several, the same one is read whatever the order of d.
+	var inexact map[*fieldDecoder]docKey
+	for k := range d {
+		if f, rank, ok := sd.forDocField(k); ok && rank > 0 {
+			if inexact == nil {
+				inexact = make(map[*fieldDecoder]docKey)
+			}
+			dk := docKey{name: k, rank: rank}
+			if prev, ok := inexact[f]; !ok || dk.precedes(prev) {
+				inexact[f] = dk
+			}
+		}
+	}
+	read := make(map[*fieldDecoder]bool, len(d))
 	for k, dd := range d {
-		for _, f := range fs { // TODO: make fs hold a map
-			if f.Name == k {
-				rf := v.FieldByIndex(f.Index)
-				if f.TagOptions.reference != "" && dd != nil {
-					if ds, ok := dd.([]interface{}); ok {
-						if err := populateForeignKeySlice(rf, ds); err != nil {
-							return err
-						}
-					} else if dm, ok := dd.(map[string]interface{}); ok {
-						if err := populateForeignKeyMap(rf, dm); err != nil {
-							return err
-						}
-					} else if err := populateForeignKey(rf, dd); err != nil {
-						return err
-					}
-
-				} else if err := dataToValue(rf, dd); err != nil {
-					return err
+		f, rank, ok := sd.forDocField(k)
+		if !ok {
+			switch {
+			case remain.IsValid():
+				if remain.IsNil() {
+					remain.Set(reflect.MakeMap(remain.Type()))
 				}
-				continue OUTER
+				remain.SetMapIndex(reflect.ValueOf(k), reflect.ValueOf(&dd).Elem())
+			case dec.unknown == IgnoreUnknownFields:
+			default:
+				err := errors.New("calcifer: no struct field matches the document field")
+				return (&DecodeError{FirestoreType: reflect.TypeOf(dd), err: err}).in(k)
+			}
+			continue
+		}
+		if rank > 0 {
+			if _, ok := d[f.Name]; ok || inexact[f].name != k {
+				continue // the field's own name, or a preceding key, takes precedence
+			}
+		}
+		if f.compute != nil || f.TagOptions.writeonly {
+			continue // computed fields are set below
+		}
+		read[f] = true
+		rf := v.FieldByIndex(f.Index)
+		if f.TagOptions.reference != "" && dd != nil {
+			var err error
+			col := f.TagOptions.reference
+			if ds, ok := dd.([]interface{}); ok {
+				err = populateForeignKeySlice(rf, ds, col)
+			} else if dm, ok := dd.(map[string]interface{}); ok {
+				err = populateForeignKeyMap(rf, dm, col)
+			} else {
+				err = populateForeignKey(rf, dd, col)
 			}
+			if err != nil {
+				return decodeErr(f.Type, dd, err).in(k)
+			}
+		} else if err := f.dec(dec, rf, dd); err != nil {
+			return decodeErr(f.Type, dd, err).in(k)
 		}
-		return fmt.Errorf("calcifer: no struct field matched document field %q", k)
+	}
+	// Fields that d lacks are read as zero values, as omitempty writes them.
+	for i := range sd.fields {
+		if f := &sd.fields[i]; !read[f] && f.compute == nil && !f.TagOptions.writeonly {
+			rf := v.FieldByIndex(f.Index)
+			rf.Set(reflect.Zero(rf.Type()))
+		}
+	}
+	for _, i := range sd.compute {
+		f := &sd.fields[i]
+		cv, err := f.compute(v)
+		if err != nil {
+			return decodeErr(f.Type, d[f.Name], err).in(f.Name)
+		}
+		v.FieldByIndex(f.Index).Set(cv)
 	}
 	return nil
 }
 
-func populateMap(v reflect.Value, d map[string]interface{}) error {
-	return errors.New("calcifer: populateMap: unimplemented")
+func newMapDecoder(t reflect.Type) decoderFunc {
+	var keyErr error
+	if t.Key().Kind() != reflect.String {
+		keyErr = fmt.Errorf("calcifer: cannot set map with non-string key type %s", t.Key())
+	}
+	et := t.Elem()
+	elemDec := typeDecoder(et)
+	return func(dec *decoder, v reflect.Value, d interface{}) error {
+		x, ok := dataMap(reflect.ValueOf(d))
+		if !ok {
+			return typeErr(v, d)
+		}
+		if keyErr != nil {
+			return keyErr
+		}
+		v.Set(reflect.MakeMapWithSize(t, len(x)))
+		for k, dd := range x {
+			el := reflect.New(et).Elem()
+			if err := elemDec(dec, el, dd); err != nil {
+				return decodeErr(et, dd, err).in(k)
+			}
+			v.SetMapIndex(reflect.ValueOf(k).Convert(t.Key()), el)
+		}
+		return nil
+	}
 }
 
-func populateForeignKey(v reflect.Value, dd interface{}) error {
-	d, ok := dd.(string)
-	if !ok {
-		return fmt.Errorf("calcifier: cannot use non-string value %q as foreign key", reflect.TypeOf(dd))
+// populateForeignKey sets the ID of the model v to that of the document of
+// collection col referred to by dd, which is stored in any form of refStorage.
+func populateForeignKey(v reflect.Value, dd interface{}, col string) error {
+	var (
+		d   string
+		err error
+	)
+	switch x := dd.(type) {
+	case nil:
+	case string:
+		d, err = foreignKeyID(x, col)
+	case *firestore.DocumentRef:
+		d, err = foreignKeyID(x.Path, col)
+	default:
+		return fmt.Errorf("calcifer: cannot use value of type %s as foreign key", reflect.TypeOf(dd))
+	}
+	if err != nil {
+		return err
 	}
 	if d == "" {
 		v.Set(reflect.Zero(v.Type())) // zero value struct or nil pointer
@@ -230,7 +737,7 @@ func populateForeignKey(v reflect.Value, dd interface{}) error {
 		}
 		v = v.Elem()
 	}
-	sv := v.FieldByName("ID")
+	sv := fieldByName(v, "ID")
 	if sv.Kind() != reflect.String {
 		return errors.New("calcifer: missing string ID field on foreign key model")
 	}
@@ -238,7 +745,21 @@ func populateForeignKey(v reflect.Value, dd interface{}) error {
 	return nil
 }
 
-func populateForeignKeySlice(v reflect.Value, d []interface{}) error {
+// foreignKeyID returns the ID of the document of collection col that s refers
+// to. s is either the ID itself, or the path of the document, either relative
+// to the database, as in "users/1", or absolute, as in Firestore references.
+func foreignKeyID(s, col string) (string, error) {
+	i := strings.LastIndexByte(s, '/')
+	if i < 0 {
+		return s, nil
+	}
+	if parent := s[:i]; parent != col && !strings.HasSuffix(parent, "/documents/"+col) {
+		return "", fmt.Errorf("calcifer: %q is not a document of collection %q", s, col)
+	}
+	return s[i+1:], nil
+}
+
+func populateForeignKeySlice(v reflect.Value, d []interface{}, col string) error {
 	vlen := v.Len()
 	dlen := len(d)
 	// Make a slice of the right size, avoiding allocation if possible.
@@ -249,14 +770,14 @@ func populateForeignKeySlice(v reflect.Value, d []interface{}) error {
 	}
 
 	for i := 0; i < dlen; i++ {
-		if err := populateForeignKey(v.Index(i), d[i]); err != nil {
-			return err
+		if err := populateForeignKey(v.Index(i), d[i], col); err != nil {
+			return decodeErr(v.Type().Elem(), d[i], err).in(strconv.Itoa(i))
 		}
 	}
 	return nil
 }
 
-func populateForeignKeyMap(v reflect.Value, d map[string]interface{}) error {
+func populateForeignKeyMap(v reflect.Value, d map[string]interface{}, col string) error {
 	vt := v.Type()
 	if v.IsNil() {
 		v.Set(reflect.MakeMap(vt))
@@ -264,8 +785,8 @@ func populateForeignKeyMap(v reflect.Value, d map[string]interface{}) error {
 	et := vt.Elem()
 	for k := range d {
 		el := reflect.New(et).Elem()
-		if err := populateForeignKey(el, d[k]); err != nil {
-			return err
+		if err := populateForeignKey(el, d[k], col); err != nil {
+			return decodeErr(et, d[k], err).in(k)
 		}
 		v.SetMapIndex(reflect.ValueOf(k), el)
 	}
@@ -15,30 +15,35 @@
 package calcifer
 
 import (
+	"fmt"
+	"math"
 	"reflect"
 	"testing"
 	"time"
 
+	"cloud.google.com/go/firestore"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/type/latlng"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func TestDataToValueBool(t *testing.T) {
 	var b bool
-	assert.NoError(t, dataToValue(reflect.ValueOf(&b), true))
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&b), true))
 	assert.True(t, b)
-	assert.NoError(t, dataToValue(reflect.ValueOf(&b), false))
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&b), false))
 	assert.False(t, b)
 }
 
 func TestDataToValueString(t *testing.T) {
 	var s string
-	assert.NoError(t, dataToValue(reflect.ValueOf(&s), "Hello, world!"))
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&s), "Hello, world!"))
 	assert.Equal(t, "Hello, world!", s)
 }
 
 func TestDataToValueInt(t *testing.T) {
 	var i int
-	assert.NoError(t, dataToValue(reflect.ValueOf(&i), int(42)))
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&i), int(42)))
 	assert.Equal(t, 42, i)
 }
 
@@ -46,35 +51,83 @@ func TestDataToValueTime(t *testing.T) {
 	var ts time.Time
 	now := time.Now()
 	want := now
-	assert.NoError(t, dataToValue(reflect.ValueOf(&ts), now))
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&ts), now))
 	assert.True(t, want.Equal(now))
 }
 
 func TestDataToValuePointer(t *testing.T) {
 	v := 42
 	var i int
-	assert.NoError(t, dataToValue(reflect.ValueOf(&i), &v))
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&i), &v))
 	assert.Equal(t, 42, i)
 }
 
 func TestDataPointerToValue(t *testing.T) {
 	var i *int
-	assert.NoError(t, dataToValue(reflect.ValueOf(&i), int(42)))
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&i), int(42)))
 	assert.Equal(t, 42, *i)
 }
 
 func TestDataToValueMap(t *testing.T) {
-	t.Skip("populateMap: unimplemented")
 	var m map[string]string
 	d := map[string]interface{}{"a": "A", "b": "B"}
-	assert.NoError(t, dataToValue(reflect.ValueOf(&m), d))
-	assert.Equal(t, d, m)
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&m), d))
+	assert.Equal(t, map[string]string{"a": "A", "b": "B"}, m)
+
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&m), map[string]interface{}{}))
+	assert.NotNil(t, m)
+	assert.Empty(t, m)
+}
+
+func TestDataToValueMapOfNested(t *testing.T) {
+	type coord struct {
+		X int `calcifer:"x"`
+		Y int `calcifer:"y"`
+	}
+	var structs map[string]coord
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&structs), map[string]interface{}{
+		"a": map[string]interface{}{"x": int64(1), "y": int64(2)},
+	}))
+	assert.Equal(t, map[string]coord{"a": {1, 2}}, structs)
+
+	var ptrs map[string]*coord
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&ptrs), map[string]interface{}{
+		"a": map[string]interface{}{"x": int64(1)},
+		"b": nil,
+	}))
+	assert.Equal(t, map[string]*coord{"a": {X: 1}, "b": nil}, ptrs)
+
+	var slices map[string][]int
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&slices), map[string]interface{}{
+		"a": []interface{}{int64(1), int64(2)},
+	}))
+	assert.Equal(t, map[string][]int{"a": {1, 2}}, slices)
+
+	var anys map[string]any
+	d := map[string]interface{}{
+		"s": "str",
+		"n": int64(3),
+		"m": map[string]interface{}{"k": true},
+		"l": []interface{}{"x", nil},
+		"z": nil,
+	}
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&anys), d))
+	assert.Equal(t, map[string]any(d), anys)
+
+	type key string
+	var named map[key]int
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&named), map[string]interface{}{"a": int64(1)}))
+	assert.Equal(t, map[key]int{"a": 1}, named)
+
+	var bad map[string]int
+	err := (&decoder{}).dataToValue(reflect.ValueOf(&bad), map[string]interface{}{"a": "one"})
+	assert.ErrorContains(t, err, `"a"`)
 }
 
 func TestDataToValueSlice(t *testing.T) {
 	var s []string
 	d := []string{"a", "b", "c"}
-	assert.NoError(t, dataToValue(reflect.ValueOf(&s), d))
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&s), d))
 	assert.Equal(t, d, s)
 }
 
@@ -86,7 +139,7 @@ func TestDataToValueStruct(t *testing.T) {
 	}
 	var s testModel
 	d := map[string]interface{}{"id": "1", "name": "Dave", "elo_score": 2500}
-	assert.NoError(t, dataToValue(reflect.ValueOf(&s), d))
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&s), d))
 	assert.Equal(t, "1", s.ID)
 	assert.Equal(t, "Dave", s.Name)
 	assert.Equal(t, 2500, s.ELO)
@@ -99,19 +152,17 @@ func TestDataToValueRelatedStruct(t *testing.T) {
 	}
 	type testModel struct {
 		Model
-		Rel      relatedModel            `calcifer:"rel,ref:foo"`
 		RelSlice []relatedModel          `calcifer:"relslice,ref:foo"`
 		RelMap   map[string]relatedModel `calcifer:"relmap,ref:foo"`
 	}
 	var s testModel
 	d := map[string]interface{}{
-		"id": "1", "rel": "2",
+		"id":       "1",
 		"relslice": []any{"3", "4"},
 		"relmap":   map[string]any{"five": "5", "six": "6"},
 	}
-	assert.NoError(t, dataToValue(reflect.ValueOf(&s), d))
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&s), d))
 	assert.Equal(t, "1", s.ID)
-	assert.Equal(t, "2", s.Rel.ID)
 	assert.Equal(t, []relatedModel{{Model{ID: "3"}, 0}, {Model{ID: "4"}, 0}}, s.RelSlice)
 	assert.Equal(t, map[string]relatedModel{"five": {Model{ID: "5"}, 0}, "six": {Model{ID: "6"}, 0}}, s.RelMap)
 }
@@ -130,7 +181,7 @@ func TestDataToValueRelatedPtr(t *testing.T) {
 	d1 := map[string]interface{}{
 		"id": "1", "rel": "2",
 	}
-	assert.NoError(t, dataToValue(reflect.ValueOf(&s1), d1))
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&s1), d1))
 	assert.Equal(t, "1", s1.ID)
 	assert.Equal(t, "2", s1.Rel.ID)
 
@@ -138,7 +189,7 @@ func TestDataToValueRelatedPtr(t *testing.T) {
 	d2 := map[string]interface{}{
 		"id": "1", "rel": "",
 	}
-	assert.NoError(t, dataToValue(reflect.ValueOf(&s2), d2))
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&s2), d2))
 	assert.Equal(t, "1", s2.ID)
 	assert.Nil(t, s2.Rel)
 
@@ -146,7 +197,339 @@ func TestDataToValueRelatedPtr(t *testing.T) {
 	d3 := map[string]interface{}{
 		"id": "1",
 	}
-	assert.NoError(t, dataToValue(reflect.ValueOf(&s3), d3))
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&s3), d3))
 	assert.Equal(t, "1", s3.ID)
 	assert.Nil(t, s3.Rel)
 }
+
+func TestDataToValueFloat(t *testing.T) {
+	var f64 float64
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&f64), 2.5))
+	assert.Equal(t, 2.5, f64)
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&f64), int64(-3)))
+	assert.Equal(t, -3.0, f64)
+	assert.Error(t, (&decoder{}).dataToValue(reflect.ValueOf(&f64), int64(1<<53+1)))
+
+	var f32 float32
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&f32), 0.25))
+	assert.Equal(t, float32(0.25), f32)
+	assert.Error(t, (&decoder{}).dataToValue(reflect.ValueOf(&f32), 1e300))
+	assert.Error(t, (&decoder{}).dataToValue(reflect.ValueOf(&f32), "0.25"))
+}
+
+func TestDataToValueNumericCoercion(t *testing.T) {
+	var i int
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&i), int64(-42)))
+	assert.Equal(t, -42, i)
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&i), 42.0))
+	assert.Equal(t, 42, i)
+	assert.Error(t, (&decoder{}).dataToValue(reflect.ValueOf(&i), 42.5))
+	assert.Error(t, (&decoder{}).dataToValue(reflect.ValueOf(&i), 1e19))
+	assert.Error(t, (&decoder{}).dataToValue(reflect.ValueOf(&i), true))
+
+	var i8 int8
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&i8), int64(-128)))
+	assert.Equal(t, int8(-128), i8)
+	assert.Error(t, (&decoder{}).dataToValue(reflect.ValueOf(&i8), int64(128)))
+
+	var u uint
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&u), int64(42)))
+	assert.Equal(t, uint(42), u)
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&u), 42.0))
+	assert.Equal(t, uint(42), u)
+	assert.Error(t, (&decoder{}).dataToValue(reflect.ValueOf(&u), int64(-1)))
+
+	var u64 uint64
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&u64), int64(math.MaxInt64)))
+	assert.Equal(t, uint64(math.MaxInt64), u64)
+
+	var u16 uint16
+	assert.Error(t, (&decoder{}).dataToValue(reflect.ValueOf(&u16), int64(1<<16)))
+}
+
+func TestDataToValueNumericErrorNamesField(t *testing.T) {
+	type stats struct {
+		Score int `calcifer:"score"`
+	}
+	type testModel struct {
+		Model
+		Stats stats `calcifer:"stats"`
+	}
+	var s testModel
+	d := map[string]interface{}{"stats": map[string]interface{}{"score": 2.5}}
+	err := (&decoder{}).dataToValue(reflect.ValueOf(&s), d)
+	assert.ErrorContains(t, err, `"stats.score"`)
+	assert.ErrorContains(t, err, "2.5")
+}
+
+func TestDataToValueDecodeError(t *testing.T) {
+	type pet struct {
+		Name string `calcifer:"name"`
+	}
+	type relatedModel struct {
+		Model
+	}
+	type testModel struct {
+		Model
+		Pets    []pet                   `calcifer:"pets"`
+		ByName  map[string]*pet         `calcifer:"by_name"`
+		Friends []relatedModel          `calcifer:"friends,ref:users"`
+		Groups  map[string]relatedModel `calcifer:"groups,ref:groups"`
+	}
+	for _, tc := range []struct {
+		d             map[string]interface{}
+		field         string
+		goType        reflect.Type
+		firestoreType reflect.Type
+	}{
+		{
+			d:             map[string]interface{}{"pets": []interface{}{map[string]interface{}{"name": "Rex"}, map[string]interface{}{"name": int64(7)}}},
+			field:         "pets.1.name",
+			goType:        reflect.TypeOf(""),
+			firestoreType: reflect.TypeOf(int64(0)),
+		},
+		{
+			d:             map[string]interface{}{"by_name": map[string]interface{}{"rex": "Rex"}},
+			field:         "by_name.rex",
+			goType:        reflect.TypeOf(pet{}),
+			firestoreType: reflect.TypeOf(""),
+		},
+		{
+			d:             map[string]interface{}{"friends": []interface{}{"1", true}},
+			field:         "friends.1",
+			goType:        reflect.TypeOf(relatedModel{}),
+			firestoreType: reflect.TypeOf(true),
+		},
+		{
+			d:             map[string]interface{}{"groups": map[string]interface{}{"admins": int64(1)}},
+			field:         "groups.admins",
+			goType:        reflect.TypeOf(relatedModel{}),
+			firestoreType: reflect.TypeOf(int64(0)),
+		},
+		{
+			d:             map[string]interface{}{"pets": []interface{}{map[string]interface{}{"age": int64(3)}}},
+			field:         "pets.0.age",
+			firestoreType: reflect.TypeOf(int64(0)),
+		},
+	} {
+		var m testModel
+		err := (&decoder{}).dataToValue(reflect.ValueOf(&m), tc.d)
+		var de *DecodeError
+		if assert.ErrorAs(t, err, &de, tc.field) {
+			assert.Equal(t, tc.field, de.Field)
+			assert.Equal(t, tc.goType, de.GoType, tc.field)
+			assert.Equal(t, tc.firestoreType, de.FirestoreType, tc.field)
+			assert.ErrorContains(t, err, fmt.Sprintf("(field %q)", tc.field))
+		}
+	}
+
+	var n int
+	err := (&decoder{}).dataToValue(reflect.ValueOf(&n), "7")
+	var de *DecodeError
+	if assert.ErrorAs(t, err, &de) {
+		assert.Equal(t, "", de.Field)
+		assert.Equal(t, reflect.TypeOf(0), de.GoType)
+		assert.Equal(t, reflect.TypeOf(""), de.FirestoreType)
+	}
+	de.Document = "users/1"
+	assert.Equal(t, `calcifer: cannot set type int to string (document "users/1")`, err.Error())
+}
+
+func TestDataToValueNativeTypes(t *testing.T) {
+	type testModel struct {
+		Model
+		Where   *latlng.LatLng           `calcifer:"where"`
+		When    *timestamppb.Timestamp   `calcifer:"when"`
+		Raw     *firestore.DocumentRef   `calcifer:"raw"`
+		Ref     *DocumentRef             `calcifer:"ref"`
+		Refs    []*firestore.DocumentRef `calcifer:"refs"`
+		Missing *latlng.LatLng           `calcifer:"missing"`
+	}
+	now := time.Now().UTC()
+	ll := &latlng.LatLng{Latitude: 51.5, Longitude: -0.1}
+	fr := &firestore.DocumentRef{ID: "1", Path: "projects/p/databases/(default)/documents/users/1"}
+	m := testModel{
+		Where: ll,
+		When:  timestamppb.New(now),
+		Raw:   fr,
+		Ref:   &DocumentRef{DocumentRef: fr},
+		Refs:  []*firestore.DocumentRef{fr, nil},
+	}
+	i, err := modelToDoc(m)
+	assert.NoError(t, err)
+	d := i.(map[string]interface{})
+	assert.Same(t, ll, d["where"])
+	assert.Same(t, fr, d["raw"])
+	assert.Same(t, fr, d["ref"])
+	assert.Nil(t, d["missing"])
+
+	// Firestore reads timestamps as time.Time.
+	d["when"] = now
+	cli := &Client{}
+	var m2 testModel
+	assert.NoError(t, (&decoder{cli: cli}).dataToValue(reflect.ValueOf(&m2), d))
+	assert.Same(t, ll, m2.Where)
+	assert.True(t, m2.When.AsTime().Equal(now))
+	assert.Same(t, fr, m2.Raw)
+	assert.Same(t, fr, m2.Ref.DocumentRef)
+	assert.Same(t, cli, m2.Ref.cli)
+	assert.Equal(t, []*firestore.DocumentRef{fr, nil}, m2.Refs)
+	assert.Nil(t, m2.Missing)
+
+	assert.Error(t, (&decoder{}).dataToValue(reflect.ValueOf(&m2), map[string]interface{}{"where": "London"}))
+
+	type byValue struct {
+		Where latlng.LatLng `calcifer:"where"`
+	}
+	_, err = valueToInterface(reflect.ValueOf(&byValue{}))
+	assert.ErrorContains(t, err, "must be used by pointer")
+}
+
+func TestDataToValueUnknownFields(t *testing.T) {
+	type testModel struct {
+		Model
+		Name string `calcifer:"name"`
+	}
+	d := map[string]interface{}{"name": "Dave", "age": int64(42)}
+	var m testModel
+	assert.ErrorContains(t, (&decoder{}).dataToValue(reflect.ValueOf(&m), d), `"age"`)
+	assert.NoError(t, (&decoder{unknown: IgnoreUnknownFields}).dataToValue(reflect.ValueOf(&m), d))
+	assert.Equal(t, "Dave", m.Name)
+}
+
+type strictModel struct {
+	Model
+	Name string `calcifer:"name"`
+}
+
+func (*strictModel) UnknownFieldPolicy() UnknownFieldPolicy { return RejectUnknownFields }
+
+type laxModel struct {
+	Model
+	Name string `calcifer:"name"`
+}
+
+func (*laxModel) UnknownFieldPolicy() UnknownFieldPolicy { return IgnoreUnknownFields }
+
+func TestModelUnknownFieldPolicy(t *testing.T) {
+	d := map[string]interface{}{"name": "Dave", "age": int64(42)}
+
+	// The policy of the model takes precedence over that of the client.
+	var strict strictModel
+	cli := NewClient(nil, IgnoreUnknownFields)
+	assert.ErrorContains(t, cli.modelDecoder(&strict).dataToValue(reflect.ValueOf(&strict), d), `"age"`)
+	var lax laxModel
+	cli = NewClient(nil)
+	assert.NoError(t, cli.modelDecoder(&lax).dataToValue(reflect.ValueOf(&lax), d))
+	assert.Equal(t, "Dave", lax.Name)
+
+	// Other models follow the client.
+	var m User
+	d = map[string]interface{}{"Email": "dave@example.com", "age": int64(42)}
+	assert.Error(t, cli.modelDecoder(&m).dataToValue(reflect.ValueOf(&m), d))
+	cli = NewClient(nil, IgnoreUnknownFields)
+	assert.NoError(t, cli.modelDecoder(&m).dataToValue(reflect.ValueOf(&m), d))
+}
+
+func TestRemainFieldRoundTrip(t *testing.T) {
+	type address struct {
+		City  string                 `calcifer:"city"`
+		Extra map[string]interface{} `calcifer:",remain"`
+	}
+	type testModel struct {
+		Model
+		Name    string                 `calcifer:"name"`
+		Address address                `calcifer:"address"`
+		Extra   map[string]interface{} `calcifer:",remain"`
+	}
+	d := map[string]interface{}{
+		"name":    "Dave",
+		"age":     int64(42),
+		"tags":    []interface{}{"a", nil},
+		"nothing": nil,
+		"address": map[string]interface{}{"city": "London", "zip": "N1"},
+	}
+	m := testModel{Extra: map[string]interface{}{"stale": true}}
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&m), d))
+	assert.Equal(t, "Dave", m.Name)
+	assert.Equal(t, map[string]interface{}{"age": int64(42), "tags": []interface{}{"a", nil}, "nothing": nil}, m.Extra)
+	assert.Equal(t, map[string]interface{}{"zip": "N1"}, m.Address.Extra)
+
+	m.Extra["name"] = "shadowed by the name field"
+	i, err := modelToDoc(m)
+	assert.NoError(t, err)
+	im := i.(map[string]interface{})
+	assert.Equal(t, "Dave", im["name"])
+	assert.Equal(t, int64(42), im["age"])
+	assert.Equal(t, []interface{}{"a", nil}, im["tags"])
+	assert.Contains(t, im, "nothing")
+	assert.NotContains(t, im, "Extra")
+	assert.Equal(t, map[string]interface{}{"city": "London", "zip": "N1"}, im["address"])
+}
+
+func TestDataToValueFieldMatching(t *testing.T) {
+	type testModel struct {
+		Model
+		Name  string `calcifer:"name,alias:fullName,alias:full_name"`
+		Email string
+	}
+	var m testModel
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&m), map[string]interface{}{"NAME": "Dave", "email": "d@example.com"}))
+	assert.Equal(t, "Dave", m.Name)
+	assert.Equal(t, "d@example.com", m.Email)
+
+	m = testModel{}
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&m), map[string]interface{}{"full_name": "Dave"}))
+	assert.Equal(t, "Dave", m.Name)
+
+	// The field's own name takes precedence over aliases and other cases.
+	for i := 0; i < 10; i++ {
+		m = testModel{}
+		assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&m), map[string]interface{}{
+			"fullName": "Old Dave",
+			"Name":     "Other Dave",
+			"name":     "Dave",
+		}))
+		assert.Equal(t, "Dave", m.Name)
+	}
+
+	// Without it, aliases take precedence in tag order, then other cases in
+	// lexical order.
+	for i := 0; i < 10; i++ {
+		m = testModel{}
+		assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&m), map[string]interface{}{
+			"full_name": "Older Dave",
+			"fullName":  "Old Dave",
+			"NAME":      "Loud Dave",
+		}))
+		assert.Equal(t, "Old Dave", m.Name)
+
+		m = testModel{}
+		assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&m), map[string]interface{}{
+			"NAME": "Loud Dave",
+			"Name": "Other Dave",
+			"nAme": "Odd Dave",
+		}))
+		assert.Equal(t, "Loud Dave", m.Name)
+	}
+}
+
+func BenchmarkDataToValue(b *testing.B) {
+	// The Event of benchmarkEvent, as returned by firestore.DocumentSnapshot.Data.
+	d := map[string]interface{}{
+		"Description": "An Unexpected Party",
+		"attendees":   []interface{}{"bilbo", "gandalf", "thorin"},
+		"beverages":   []interface{}{"tea", "ale"},
+		"location":    "bag-end",
+		"start":       time.Date(1937, time.September, 21, 17, 0, 0, 0, time.UTC),
+		"end":         time.Date(1937, time.September, 22, 06, 0, 0, 0, time.UTC),
+	}
+	dec := &decoder{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var e Event
+		if err := dec.dataToValue(reflect.ValueOf(&e), d); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -16,8 +16,13 @@ package calcifer
 
 import (
 	"context"
+	"errors"
+	"reflect"
+	"time"
 
 	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type DocumentRef struct {
@@ -33,17 +38,20 @@ func (d *DocumentRef) Collection(id string) *CollectionRef {
 }
 
 // Get fetches the document referred to by d from Firestore, and unmarshals it into p.
-func (d *DocumentRef) Get(ctx context.Context, p MutableModel) error {
+// The documents referred to by the reference fields of p are read into them in
+// turn, unless NoExpand or Expand options say otherwise, to a depth limited by
+// MaxExpandDepth; references beyond it are left unexpanded by default.
+func (d *DocumentRef) Get(ctx context.Context, p MutableModel, opts ...ReadOption) error {
 	doc, err := d.DocumentRef.Get(ctx)
 	if err != nil {
 		return err
 	}
-	if err := docToModel(p, doc); err != nil {
+	if err := d.cli.readModel(ctx, p, doc); err != nil {
 		return err
 	}
 
-	// TODO: make expansion optional
-	if err := d.cli.expandModel(ctx, p); err != nil {
+	rc := newReadConfig(opts)
+	if err := d.cli.newExpander(rc).expand(ctx, p, doc, rc.expand); err != nil {
 		return err
 	}
 	// TODO: configurable retry-loops
@@ -51,19 +59,136 @@ func (d *DocumentRef) Get(ctx context.Context, p MutableModel) error {
 }
 
 // Set writes a Model to Firestore at the path referred to by d.
-func (d *DocumentRef) Set(ctx context.Context, m ReadableModel) error {
-	sm, err := modelToDoc(m)
+// By default the whole document is overwritten; pass MergeAll or Merge
+// to write only some of its fields, or IfUnchanged to detect concurrent writes.
+// Nothing is written if the fields to be written fail validation; see
+// ValidationError. With Merge, only the merged fields are checked.
+//
+// Readonly fields are never written. Without merge options, Set of a model
+// with readonly fields merges all its other fields, deleting those it omits, so
+// that the stored readonly fields are kept, including those of a nil nested
+// struct. Stored fields that match no field of the model, such as entries
+// removed from a remain field, are then left in place.
+func (d *DocumentRef) Set(ctx context.Context, m ReadableModel, opts ...SetOption) error {
+	c := newSetConfig(opts)
+	if c.refresh {
+		if _, ok := m.(MutableModel); !ok {
+			return errRefreshNonPointer
+		}
+		if c.precondition != nil {
+			return errRefreshWithRead
+		}
+	}
+	if err := checkSet(m, c); err != nil {
+		return err
+	}
+	if c.precondition != nil {
+		return d.cli.RunTransaction(ctx, func(ctx context.Context, tx *Transaction) error {
+			return tx.set(d, m, c)
+		})
+	}
+	sm, err := (&encoder{cli: d.cli}).modelToDoc(m)
+	if err != nil {
+		return inDocument(err, d.Path)
+	}
+	fopts, err := c.firestoreSetOptions(reflect.TypeOf(m), sm)
 	if err != nil {
 		return err
 	}
 	// TODO: transactionally store model history
-	_, err = d.DocumentRef.Set(ctx, sm)
-	return err
+	wr, err := d.DocumentRef.Set(ctx, sm, fopts...)
+	if err != nil || !c.refresh {
+		return err
+	}
+	return refreshModel(m.(MutableModel), wr.UpdateTime, c.mergedPaths())
+}
+
+// Create writes a Model to Firestore at the path referred to by d, failing with
+// an *AlreadyExistsError if the document already exists. On success, the ID,
+// CreateTime and UpdateTime of m are set to those of the new document.
+func (d *DocumentRef) Create(ctx context.Context, m MutableModel, opts ...CreateOption) error {
+	c := newCreateConfig(opts)
+	cm := withID(m, d.ID)
+	if err := checkModel(cm); err != nil {
+		return err
+	}
+	sm, err := (&encoder{cli: d.cli}).modelToDoc(cm)
+	if err != nil {
+		return inDocument(err, d.Path)
+	}
+	// TODO: transactionally store model history
+	wr, err := d.DocumentRef.Create(ctx, sm)
+	if status.Code(err) == codes.AlreadyExists {
+		return &AlreadyExistsError{Path: d.Path, err: err}
+	} else if err != nil {
+		return err
+	}
+	m.setID(d.ID)
+	if c.refresh {
+		if err := refreshModel(m, wr.UpdateTime, nil); err != nil {
+			return err
+		}
+	}
+	m.setCreateTime(wr.UpdateTime)
+	m.setUpdateTime(wr.UpdateTime)
+	return nil
+}
+
+// withID returns a shallow copy of m with the given ID, leaving m untouched
+// until it has been written.
+func withID(m MutableModel, id string) MutableModel {
+	cp := reflect.New(reflect.TypeOf(m).Elem())
+	cp.Elem().Set(reflect.ValueOf(m).Elem())
+	cm := cp.Interface().(MutableModel)
+	cm.setID(id)
+	return cm
+}
+
+var errRefreshNonPointer = errors.New("calcifer: RefreshServerTimestamps requires a pointer to a model")
+
+// refreshModel updates m after it was written at time t, as requested by
+// RefreshServerTimestamps. If merged is not nil, only the fields at those paths
+// were written.
+func refreshModel(m MutableModel, t time.Time, merged []string) error {
+	if err := setServerTimestamps(reflect.ValueOf(m).Elem(), t, "", merged); err != nil {
+		return err
+	}
+	m.setUpdateTime(t)
+	return nil
+}
+
+// Update applies updates to the fields of the document referred to by d, leaving
+// its other fields untouched. The paths of the updates are resolved against the
+// fields of m's type; m's field values are not written. The document must exist.
+func (d *DocumentRef) Update(ctx context.Context, m ReadableModel, updates []Update, opts ...UpdateOption) error {
+	fu, err := (&encoder{cli: d.cli}).modelUpdates(m, updates)
+	if err != nil {
+		return inDocument(err, d.Path)
+	}
+	preconds, err := newUpdateConfig(opts).precondition.firestorePreconditions()
+	if err != nil {
+		return err
+	}
+	// TODO: transactionally store model history
+	_, err = d.DocumentRef.Update(ctx, fu, preconds...)
+	return d.conflictOrErr(err, preconds)
 }
 
 // Delete removes from Firestore the document at the path referred to by d if it exists.
-func (d *DocumentRef) Delete(ctx context.Context) error {
+func (d *DocumentRef) Delete(ctx context.Context, opts ...DeleteOption) error {
+	preconds, err := newDeleteConfig(opts).precondition.firestorePreconditions()
+	if err != nil {
+		return err
+	}
 	// TODO: transactionally store model history
-	_, err := d.DocumentRef.Delete(ctx)
+	_, err = d.DocumentRef.Delete(ctx, preconds...)
+	return d.conflictOrErr(err, preconds)
+}
+
+// conflictOrErr translates a failed precondition of a write to d into a *ConflictError.
+func (d *DocumentRef) conflictOrErr(err error, preconds []firestore.Precondition) error {
+	if len(preconds) > 0 && status.Code(err) == codes.FailedPrecondition {
+		return &ConflictError{Path: d.Path, err: err}
+	}
 	return err
 }
@@ -16,6 +16,7 @@ package calcifer
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -47,6 +48,20 @@ func testClient(t *testing.T) *Client {
 	return NewClient(cli)
 }
 
+// offlineClient returns a client for tests that need a Firestore client to
+// build references, but never connect to Firestore.
+func offlineClient(t *testing.T) *Client {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8080")
+	}
+	fs, err := firestore.NewClient(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fs.Close() })
+	return NewClient(fs)
+}
+
 type User struct {
 	Model
 
@@ -150,3 +165,313 @@ func TestSetAndGetByID(t *testing.T) {
 	assert.Equal(t, newEvent.Location.ID, savedEvent.Location.ID)
 	assert.Equal(t, newLocation.Name, savedEvent.Location.Name)
 }
+
+func TestUpdate(t *testing.T) {
+	ctx := context.Background()
+	cli := testClient(t)
+
+	locations := cli.Collection("locations")
+	bagEndRef, rivendellRef := locations.NewDoc(), locations.NewDoc()
+	assert.NoError(t, bagEndRef.Set(ctx, Location{Name: "Bag End, Hobbiton, The Shire"}))
+	assert.NoError(t, rivendellRef.Set(ctx, Location{Name: "Rivendell"}))
+
+	eventRef := cli.Collection("events").NewDoc()
+	assert.NoError(t, eventRef.Set(ctx, Event{
+		Description: "An Unexpected Party",
+		Location:    &Location{Model: Model{ID: bagEndRef.ID}},
+	}))
+
+	// Two writers touching different fields must not clobber each other.
+	assert.NoError(t, eventRef.Update(ctx, Event{}, []Update{{Path: "Description", Value: "A Long-Expected Party"}}))
+	assert.NoError(t, eventRef.Update(ctx, Event{}, []Update{{Path: "location", Value: &Location{Model: Model{ID: rivendellRef.ID}}}}))
+	assert.Error(t, eventRef.Update(ctx, Event{}, []Update{{Path: "description", Value: "lowercase"}}))
+
+	var savedEvent Event
+	assert.NoError(t, eventRef.Get(ctx, &savedEvent))
+	assert.Equal(t, "A Long-Expected Party", savedEvent.Description)
+	assert.Equal(t, rivendellRef.ID, savedEvent.Location.ID)
+	assert.Equal(t, "Rivendell", savedEvent.Location.Name)
+}
+
+func TestSetWithMerge(t *testing.T) {
+	ctx := context.Background()
+	cli := testClient(t)
+
+	locations := cli.Collection("locations")
+	bagEndRef, rivendellRef := locations.NewDoc(), locations.NewDoc()
+	assert.NoError(t, bagEndRef.Set(ctx, Location{Name: "Bag End, Hobbiton, The Shire"}))
+	assert.NoError(t, rivendellRef.Set(ctx, Location{Name: "Rivendell"}))
+
+	eventRef := cli.Collection("events").NewDoc()
+	assert.NoError(t, eventRef.Set(ctx, Event{
+		Description: "An Unexpected Party",
+		Location:    &Location{Model: Model{ID: bagEndRef.ID}},
+	}))
+
+	// Only the location is written, as an ID; the description is untouched.
+	assert.NoError(t, eventRef.Set(ctx, Event{
+		Location: &Location{Model: Model{ID: rivendellRef.ID}, Name: "ignored"},
+	}, Merge("location")))
+
+	var savedEvent Event
+	assert.NoError(t, eventRef.Get(ctx, &savedEvent))
+	assert.Equal(t, "An Unexpected Party", savedEvent.Description)
+	assert.Equal(t, rivendellRef.ID, savedEvent.Location.ID)
+	assert.Equal(t, "Rivendell", savedEvent.Location.Name)
+
+	savedEvent.Description = "A Long-Expected Party"
+	assert.NoError(t, eventRef.Set(ctx, savedEvent, MergeAll))
+	var mergedEvent Event
+	assert.NoError(t, eventRef.Get(ctx, &mergedEvent))
+	assert.Equal(t, "A Long-Expected Party", mergedEvent.Description)
+	assert.Equal(t, "Rivendell", mergedEvent.Location.Name)
+}
+
+func TestSetWithReadonlyFields(t *testing.T) {
+	ctx := context.Background()
+	cli := testClient(t)
+
+	// The likes are maintained by another service.
+	ref := cli.Collection("posts").NewDoc()
+	_, err := ref.DocumentRef.Set(ctx, map[string]interface{}{
+		"body": "Hello", "title": "Greeting", "likes": 3, "moderation": map[string]interface{}{"flagged": true},
+		"legacy": "x",
+	})
+	assert.NoError(t, err)
+
+	var p post
+	assert.NoError(t, ref.Get(ctx, &p))
+	assert.Equal(t, 3, p.Likes)
+	assert.Equal(t, map[string]interface{}{"legacy": "x"}, p.Extra)
+	delete(p.Extra, "legacy")
+	p.Body = "Hello, world"
+	p.Title = ""
+	p.Likes = 0
+	p.Moderation = moderation{Reviewer: "dave"}
+	assert.NoError(t, ref.Set(ctx, &p))
+
+	doc, err := ref.DocumentRef.Get(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"id": p.ID, "create_time": time.Time{}, "update_time": time.Time{},
+		"body": "Hello, world", "search_key": "", "likes": int64(3),
+		"moderation": map[string]interface{}{"flagged": true, "reviewer": "dave"},
+		"legacy":     "x", // not a field of post, so not deleted
+	}, doc.Data())
+
+	// A nil nested struct keeps its readonly fields.
+	type draft struct {
+		Model
+		Body       string      `calcifer:"body"`
+		Moderation *moderation `calcifer:"moderation"`
+	}
+	assert.NoError(t, ref.Set(ctx, &draft{Model: Model{ID: p.ID}, Body: "Draft"}))
+	doc, err = ref.DocumentRef.Get(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"id": p.ID, "create_time": time.Time{}, "update_time": time.Time{}, "body": "Draft",
+		"search_key": "", "likes": int64(3), "legacy": "x",
+		"moderation": map[string]interface{}{"flagged": true},
+	}, doc.Data())
+
+	// Merging or updating the nested struct keeps its readonly fields.
+	p.Moderation = moderation{Reviewer: "eve"}
+	assert.NoError(t, ref.Set(ctx, &p, Merge("moderation")))
+	assert.NoError(t, ref.Update(ctx, p, []Update{{Path: "moderation", Value: moderation{Reviewer: "fay"}}}))
+	doc, err = ref.DocumentRef.Get(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"flagged": true, "reviewer": "fay"}, doc.Data()["moderation"])
+
+	// Merging an empty omitempty field deletes it.
+	_, err = ref.DocumentRef.Update(ctx, []firestore.Update{{Path: "title", Value: "Greeting"}})
+	assert.NoError(t, err)
+	assert.NoError(t, ref.Set(ctx, &p, Merge("title")))
+	doc, err = ref.DocumentRef.Get(ctx)
+	assert.NoError(t, err)
+	assert.NotContains(t, doc.Data(), "title")
+
+	// Such models can be set twice in a transaction, and refreshed.
+	err = cli.RunTransaction(ctx, func(ctx context.Context, tx *Transaction) error {
+		if err := tx.Set(ref, &p); err != nil {
+			return err
+		}
+		return tx.Set(cli.Collection("posts").NewDoc(), &p)
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, ref.Set(ctx, &p, RefreshServerTimestamps()))
+	assert.False(t, p.UpdateTime.IsZero())
+}
+
+func TestCreate(t *testing.T) {
+	ctx := context.Background()
+	cli := testClient(t)
+
+	users := cli.Collection("users")
+	bilbo := User{Email: "bilbo@theshire.net"}
+	bilboRef, err := users.Add(ctx, &bilbo)
+	assert.NoError(t, err)
+	assert.Equal(t, bilboRef.ID, bilbo.ID)
+	assert.NotZero(t, bilbo.CreateTime)
+	assert.Equal(t, bilbo.CreateTime, bilbo.UpdateTime)
+
+	var savedBilbo User
+	assert.NoError(t, bilboRef.Get(ctx, &savedBilbo))
+	assert.Equal(t, bilbo, savedBilbo)
+
+	impostor := User{Email: "impostor@mordor.net"}
+	err = bilboRef.Create(ctx, &impostor)
+	var aee *AlreadyExistsError
+	assert.ErrorAs(t, err, &aee)
+	assert.Equal(t, bilboRef.Path, aee.Path)
+	assert.Empty(t, impostor.ID)
+
+	gandalfRef := users.NewDoc()
+	gandalf := User{Email: "gandalf@middle-earth.org"}
+	assert.NoError(t, cli.RunTransaction(ctx, func(ctx context.Context, tx *Transaction) error {
+		return tx.Create(gandalfRef, &gandalf)
+	}))
+	assert.Equal(t, gandalfRef.ID, gandalf.ID)
+
+	saruman := User{Email: "saruman@isengard.org"}
+	err = cli.RunTransaction(ctx, func(ctx context.Context, tx *Transaction) error {
+		return tx.Create(gandalfRef, &saruman)
+	})
+	assert.ErrorAs(t, err, &aee)
+	assert.Equal(t, gandalfRef.Path, aee.Path)
+	assert.Empty(t, saruman.ID)
+
+	// A transaction that fails after a Create leaves the model untouched.
+	radagast := User{Email: "radagast@rhosgobel.org"}
+	err = cli.RunTransaction(ctx, func(ctx context.Context, tx *Transaction) error {
+		if err := tx.Create(users.NewDoc(), &radagast); err != nil {
+			return err
+		}
+		return errors.New("abandoned")
+	})
+	assert.EqualError(t, err, "abandoned")
+	assert.Empty(t, radagast.ID)
+}
+
+func TestIfUnchanged(t *testing.T) {
+	ctx := context.Background()
+	cli := testClient(t)
+
+	users := cli.Collection("users")
+	bilbo := User{Email: "bilbo@theshire.net"}
+	bilboRef, err := users.Add(ctx, &bilbo)
+	assert.NoError(t, err)
+
+	var first, second User
+	assert.NoError(t, bilboRef.Get(ctx, &first))
+	assert.NoError(t, bilboRef.Get(ctx, &second))
+
+	first.Email = "bilbo@rivendell.net"
+	assert.NoError(t, bilboRef.Set(ctx, first, IfUnchanged(first)))
+
+	// second was read before first was written.
+	var ce *ConflictError
+	second.Email = "baggins@theshire.net"
+	assert.ErrorAs(t, bilboRef.Set(ctx, second, IfUnchanged(second)), &ce)
+	assert.Equal(t, bilboRef.Path, ce.Path)
+	assert.ErrorAs(t, bilboRef.Update(ctx, second, []Update{{Path: "Email", Value: second.Email}}, IfUnchanged(second)), &ce)
+	assert.ErrorAs(t, bilboRef.Delete(ctx, IfUnchanged(second)), &ce)
+
+	// A model that was never stored conflicts with any existing document.
+	assert.ErrorAs(t, bilboRef.Set(ctx, User{}, IfUnchanged(User{})), &ce)
+	assert.NoError(t, users.NewDoc().Set(ctx, User{}, IfUnchanged(User{})))
+
+	var current User
+	assert.NoError(t, bilboRef.Get(ctx, &current))
+	assert.Equal(t, "bilbo@rivendell.net", current.Email)
+	assert.NoError(t, bilboRef.Update(ctx, current, []Update{{Path: "Email", Value: "bilbo@undying-lands.net"}}, IfUnchanged(current)))
+
+	err = cli.RunTransaction(ctx, func(ctx context.Context, tx *Transaction) error {
+		return tx.Delete(bilboRef, IfUnchanged(current))
+	})
+	assert.ErrorAs(t, err, &ce)
+	assert.Equal(t, bilboRef.Path, ce.Path)
+
+	assert.NoError(t, bilboRef.Get(ctx, &current))
+	assert.NoError(t, bilboRef.Delete(ctx, IfUnchanged(current)))
+}
+
+func TestServerTimestamps(t *testing.T) {
+	ctx := context.Background()
+	cli := testClient(t)
+
+	type Post struct {
+		Model
+		Body     string    `calcifer:"body"`
+		PostedAt time.Time `calcifer:"posted_at,serverTimestamp"`
+		EditedAt time.Time `calcifer:"edited_at,serverTimestamp:always"`
+	}
+
+	post := Post{Body: "Hello, World!"}
+	postRef, err := cli.Collection("posts").Add(ctx, &post, RefreshServerTimestamps())
+	assert.NoError(t, err)
+	assert.Equal(t, post.CreateTime, post.PostedAt)
+	assert.Equal(t, post.CreateTime, post.EditedAt)
+
+	postedAt := post.PostedAt
+	post.Body = "Hello again, World!"
+	assert.NoError(t, postRef.Set(ctx, &post, RefreshServerTimestamps()))
+	assert.Equal(t, postedAt, post.PostedAt)
+	assert.True(t, post.EditedAt.After(postedAt))
+	assert.Equal(t, post.UpdateTime, post.EditedAt)
+
+	var savedPost Post
+	assert.NoError(t, postRef.Get(ctx, &savedPost))
+	assert.Equal(t, post, savedPost)
+
+	assert.Error(t, postRef.Set(ctx, post, RefreshServerTimestamps()))
+	assert.Error(t, postRef.Set(ctx, &post, IfUnchanged(post), RefreshServerTimestamps()))
+
+	// A merge refreshes only the fields it writes.
+	editedAt := post.EditedAt
+	post.Body = "Goodbye, World!"
+	post.PostedAt = time.Time{}
+	assert.NoError(t, postRef.Set(ctx, &post, Merge("body", "edited_at"), RefreshServerTimestamps()))
+	assert.True(t, post.PostedAt.IsZero())
+	assert.True(t, post.EditedAt.After(editedAt))
+
+	err = cli.RunTransaction(ctx, func(ctx context.Context, tx *Transaction) error {
+		return tx.Set(postRef, &post, RefreshServerTimestamps())
+	})
+	assert.Error(t, err)
+}
+
+func TestGetWithExpandOptions(t *testing.T) {
+	ctx := context.Background()
+	cli := testClient(t)
+
+	userRef := cli.Collection("users").NewDoc()
+	assert.NoError(t, userRef.Set(ctx, User{Email: "elrond@rivendell.org"}))
+	locationRef := cli.Collection("locations").NewDoc()
+	assert.NoError(t, locationRef.Set(ctx, Location{Name: "Rivendell"}))
+	eventRef := cli.Collection("events").NewDoc()
+	assert.NoError(t, eventRef.Set(ctx, Event{
+		Description: "The Council of Elrond",
+		Location:    &Location{Model: Model{ID: locationRef.ID}},
+		Attendees:   []User{{Model: Model{ID: userRef.ID}}},
+	}))
+
+	var event Event
+	assert.NoError(t, eventRef.Get(ctx, &event, NoExpand()))
+	assert.Equal(t, locationRef.ID, event.Location.ID)
+	assert.Empty(t, event.Location.Name)
+	assert.Empty(t, event.Attendees[0].Email)
+
+	event = Event{}
+	assert.NoError(t, eventRef.Get(ctx, &event, Expand("location")))
+	assert.Equal(t, "Rivendell", event.Location.Name)
+	assert.Empty(t, event.Attendees[0].Email)
+
+	var events []Event
+	q := cli.Collection("events").Where("Description", "==", "The Council of Elrond")
+	assert.NoError(t, q.Documents(ctx).GetAll(ctx, &events, Expand("location")))
+	assert.Len(t, events, 1)
+	assert.Equal(t, "Rivendell", events[0].Location.Name)
+	assert.Empty(t, events[0].Attendees[0].Email)
+
+	assert.ErrorContains(t, eventRef.Get(ctx, &event, Expand("description")), "not a reference field")
+}
@@ -0,0 +1,258 @@
+// Copyright 2022 Radiopaper Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calcifer
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// An AlreadyExistsError is returned when Create fails because the document
+// already exists.
+type AlreadyExistsError struct {
+	// Path is the full path of the existing document. It is empty if the document
+	// cannot be determined, as when a transaction creates several documents.
+	Path string
+
+	err error
+}
+
+func (e *AlreadyExistsError) Error() string {
+	if e.Path == "" {
+		return "calcifer: document already exists"
+	}
+	return fmt.Sprintf("calcifer: document %q already exists", e.Path)
+}
+
+func (e *AlreadyExistsError) Unwrap() error {
+	return e.err
+}
+
+// A ConflictError is returned when a write made with IfUnchanged fails because
+// the document was modified after the model was read.
+type ConflictError struct {
+	// Path is the full path of the modified document. It is empty if the document
+	// cannot be determined, as when a transaction makes several conditional writes.
+	Path string
+
+	err error
+}
+
+func (e *ConflictError) Error() string {
+	if e.Path == "" {
+		return "calcifer: document was modified concurrently"
+	}
+	return fmt.Sprintf("calcifer: document %q was modified concurrently", e.Path)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return e.err
+}
+
+// A ModelTypeError is returned by RegisterModel, and by operations on models of
+// the type, when a type cannot be stored in Firestore. It lists every problem found.
+type ModelTypeError struct {
+	Type     reflect.Type
+	Problems []*FieldTypeError
+}
+
+func (e *ModelTypeError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "calcifer: invalid model type %s:", e.Type)
+	for _, p := range e.Problems {
+		b.WriteString("\n\t")
+		b.WriteString(p.Error())
+	}
+	return b.String()
+}
+
+// A FieldTypeError describes a problem with one field of a model type.
+type FieldTypeError struct {
+	// Path is the dot-separated Go path of the field, such as "Address.Street".
+	Path string
+
+	err error
+}
+
+func (e *FieldTypeError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Path, e.err)
+}
+
+func (e *FieldTypeError) Unwrap() error {
+	return e.err
+}
+
+// A ValidationError is returned when a model, or the values of an Update, fail
+// validation by the constraints in their struct tags or by their Validate methods.
+// Nothing is written to Firestore.
+type ValidationError struct {
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		msgs[i] = v.String()
+	}
+	return "calcifer: validation failed: " + strings.Join(msgs, "; ")
+}
+
+// A Violation describes a value that fails validation.
+type Violation struct {
+	// Field is the dot-separated calcifer path of the value, such as "address.city".
+	// The indexes of slice elements and the keys of map entries are path segments.
+	// It is empty for errors returned by the Validate method of a model.
+	Field string
+
+	// Constraint is the tag option that failed, such as "required" or "max=10",
+	// or "Validate" for errors returned by a Validate method.
+	Constraint string
+
+	// Message describes the failure, such as "must be at most 10".
+	Message string
+}
+
+func (v Violation) String() string {
+	if v.Field == "" {
+		return v.Message
+	}
+	return v.Field + " " + v.Message
+}
+
+// An ExpandDepthError is returned by reads with the FailBeyondMaxDepth policy
+// that would expand a reference beyond their maximum expansion depth; see
+// MaxExpandDepth.
+type ExpandDepthError struct {
+	Path     string // full path of the referenced document
+	MaxDepth int
+}
+
+func (e *ExpandDepthError) Error() string {
+	return fmt.Sprintf("calcifer: expanding reference to %q exceeds maximum expansion depth %d", e.Path, e.MaxDepth)
+}
+
+// A DecodeError is returned when a Firestore value cannot be read into a Go value.
+type DecodeError struct {
+	// Document is the full path of the document being read. It is empty if the
+	// value did not come from a document.
+	Document string
+
+	// Field is the dot-separated calcifer path of the value, such as "address.city".
+	// The indexes of slice elements and the keys of map entries are path segments,
+	// as in "tags.2". It is empty if the value is the whole document.
+	Field string
+
+	// GoType is the type of the Go value being set. It is nil if the value is a
+	// document field that matches no struct field.
+	GoType reflect.Type
+
+	// FirestoreType is the type of the value as returned by
+	// firestore.DocumentSnapshot.Data, such as int64 or map[string]interface{}.
+	FirestoreType reflect.Type
+
+	err error
+}
+
+func (e *DecodeError) Error() string {
+	return describeValueErr(e.err, e.Field, e.Document)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.err
+}
+
+// An EncodeError is returned when a Go value cannot be converted into a Firestore value.
+type EncodeError struct {
+	// Document is the full path of the document being written. It is empty if
+	// the value is not being written to a document.
+	Document string
+
+	// Field is the dot-separated calcifer path of the value, as in DecodeError.
+	Field string
+
+	// GoType is the type of the Go value.
+	GoType reflect.Type
+
+	err error
+}
+
+func (e *EncodeError) Error() string {
+	return describeValueErr(e.err, e.Field, e.Document)
+}
+
+func (e *EncodeError) Unwrap() error {
+	return e.err
+}
+
+func describeValueErr(err error, field, doc string) string {
+	switch {
+	case field != "" && doc != "":
+		return fmt.Sprintf("%v (field %q of document %q)", err, field, doc)
+	case field != "":
+		return fmt.Sprintf("%v (field %q)", err, field)
+	case doc != "":
+		return fmt.Sprintf("%v (document %q)", err, doc)
+	}
+	return err.Error()
+}
+
+// decodeErr returns err, which occurred while setting a value of type t from
+// the Firestore value d, as a *DecodeError. Errors that are already
+// *DecodeErrors, from decoding a descendant of the value, are returned as-is.
+func decodeErr(t reflect.Type, d interface{}, err error) *DecodeError {
+	if de, ok := err.(*DecodeError); ok {
+		return de
+	}
+	return &DecodeError{GoType: t, FirestoreType: reflect.TypeOf(d), err: err}
+}
+
+// encodeErr is like decodeErr, for errors converting a value of type t.
+func encodeErr(t reflect.Type, err error) *EncodeError {
+	if ee, ok := err.(*EncodeError); ok {
+		return ee
+	}
+	return &EncodeError{GoType: t, err: err}
+}
+
+// in attributes e to the field name of its parent value.
+func (e *DecodeError) in(name string) *DecodeError {
+	e.Field = prependPath(name, e.Field)
+	return e
+}
+
+func (e *EncodeError) in(name string) *EncodeError {
+	e.Field = prependPath(name, e.Field)
+	return e
+}
+
+func prependPath(name, path string) string {
+	if path == "" {
+		return name
+	}
+	return name + "." + path
+}
+
+// inDocument records path as the document of err, if it is a *DecodeError or
+// an *EncodeError.
+func inDocument(err error, path string) error {
+	switch e := err.(type) {
+	case *DecodeError:
+		e.Document = path
+	case *EncodeError:
+		e.Document = path
+	}
+	return err
+}
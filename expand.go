@@ -19,185 +19,691 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
 	"cloud.google.com/go/firestore"
 	"golang.org/x/sync/errgroup"
 )
 
-func (c *Client) expandField(ctx context.Context, rv reflect.Value, col string) error {
-	if rv.Kind() == reflect.Slice {
-		for i := 0; i < rv.Len(); i++ { // TODO: parallelize
-			el := rv.Index(i)
-			if el.Kind() == reflect.Pointer {
-				if el.IsNil() {
-					el.Set(reflect.New(el.Type().Elem()))
-				}
-				el = el.Elem()
-			}
-			if err := c.expandField(ctx, el.Addr(), col); err != nil {
-				return err
-			}
-		}
-		return nil
-	} else if rv.Kind() == reflect.Map {
-		return errors.New("caclifer: expansion of maps to foreign keys unimplemented")
-	} else if rv.Kind() != reflect.Pointer {
-		return errors.New("calcifier: trying to expand into non-pointer field")
+// An expansion selects the reference fields of a model whose documents are read
+// along with it, and in turn those of the fields of the referenced models.
+type expansion struct {
+	all    bool                  // expand every reference field, recursively
+	fields map[string]*expansion // by field name, if not all
+}
+
+// expandEverything is the expansion made by reads without expansion options.
+var expandEverything = &expansion{all: true}
+
+// NoExpand returns a ReadOption that stops a read from expanding any reference
+// fields: referenced models have only their IDs set.
+func NoExpand() ReadOption {
+	return &expansion{}
+}
+
+// Expand returns a ReadOption that makes a read expand only the given reference
+// fields, which are named by calcifer field name. Paths of names separated by
+// dots name the reference fields of referenced models: Expand("location.owner")
+// reads the location of a model and the owner of that location. Several paths,
+// and several Expand options, may be given.
+func Expand(paths ...string) ReadOption {
+	e := &expansion{}
+	for _, p := range paths {
+		e.add(strings.Split(p, "."))
+	}
+	return e
+}
+
+func (e *expansion) add(names []string) {
+	if e.all || len(names) == 0 {
+		return
 	}
-	if rv.IsNil() {
-		return nil
+	if e.fields == nil {
+		e.fields = make(map[string]*expansion)
 	}
-	sv := rv.Elem().FieldByName("Model") // TODO: ensure this is a calcifer.Model?
-	if sv.Kind() != reflect.Struct {
-		return errors.New("calcifer: missing Model field on foreign key reference object")
+	sub := e.fields[names[0]]
+	if sub == nil {
+		sub = &expansion{}
+		e.fields[names[0]] = sub
 	}
-	sv = sv.FieldByName("ID")
-	id := sv.String()
-	if id == "" {
-		return nil // empty field, no ID to expand
+	sub.add(names[1:])
+}
+
+// merge adds the fields selected by o to those of e.
+func (e *expansion) merge(o *expansion) {
+	if o.all {
+		e.all, e.fields = true, nil
+		return
 	}
-	ref := c.Collection(col).Doc(id)
-	if err := ref.Get(ctx, rv.Interface().(MutableModel)); err != nil {
-		return err
+	for name, sub := range o.fields {
+		e.add([]string{name})
+		e.fields[name].merge(sub)
 	}
-	return nil
 }
 
-func (c *Client) expandModel(ctx context.Context, m MutableModel) error {
-	v := reflect.ValueOf(m)
-	if v.Kind() == reflect.Pointer {
-		if v.IsNil() {
-			return nil // no model to expand
-		}
-		v = v.Elem()
+func (e *expansion) applyRead(c *readConfig) {
+	if c.expand == nil {
+		c.expand = &expansion{}
 	}
-	fs, err := defaultFieldCache.fields(v.Type())
-	if err != nil {
-		return err
+	c.expand.merge(e)
+}
+
+// field returns the expansion of the reference field named name, or nil if the
+// field is not expanded.
+func (e *expansion) field(name string) *expansion {
+	if e.all {
+		return e
+	}
+	return e.fields[name]
+}
+
+// check returns an error if e selects fields that are not reference fields of
+// model type t, whose fields are fs, or, along its paths, of the model types
+// they refer to, whether or not any model is read at that depth. prefix is the
+// path of the fields selected by e.
+func (e *expansion) check(t reflect.Type, fs fieldList, prefix string) error {
+	names := make([]string, 0, len(e.fields))
+	for name := range e.fields {
+		names = append(names, name)
 	}
-	for _, f := range fs { // TODO: parallelize
-		col := f.TagOptions.reference
-		if col == "" {
+	sort.Strings(names)
+	for _, name := range names {
+		path := joinPath(prefix, name)
+		f, ok := fs.byName(name)
+		if !ok || f.TagOptions.reference == "" {
+			return fmt.Errorf("calcifer: cannot expand %q: not a reference field of type %s", path, t)
+		}
+		sub := e.fields[name]
+		if len(sub.fields) == 0 {
 			continue
 		}
-		rv := v.FieldByIndex(f.Index)
-		if err := c.expandField(ctx, rv, col); err != nil {
+		rt := referencedType(f.Type)
+		rfs, err := defaultFieldCache.fields(rt)
+		if err != nil {
+			return err
+		}
+		if err := sub.check(rt, rfs, path); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (tx *Transaction) expandField(rv reflect.Value, col string) error {
-	if rv.Kind() == reflect.Slice {
-		for i := 0; i < rv.Len(); i++ { // TODO: parallelize
-			el := rv.Index(i)
-			if el.Kind() == reflect.Pointer {
-				if el.IsNil() {
-					el.Set(reflect.New(el.Type().Elem()))
-				}
-				el = el.Elem()
-			}
-			if err := tx.expandField(el.Addr(), col); err != nil {
-				return err
-			}
+// referencedType returns the model type referred to by a reference field of type t.
+func referencedType(t reflect.Type) reflect.Type {
+	for {
+		switch t.Kind() {
+		case reflect.Pointer, reflect.Slice, reflect.Map:
+			t = t.Elem()
+		default:
+			return t
 		}
-		return nil
-	} else if rv.Kind() == reflect.Map {
-		return errors.New("caclifer: expansion of maps to foreign keys unimplemented")
-	} else if rv.Kind() != reflect.Pointer {
-		return errors.New("calcifier: trying to expand into non-pointer field")
 	}
-	if rv.IsNil() {
-		return nil
+}
+
+// expandedFields returns the reference fields of model type t that e expands.
+func (e *expansion) expandedFields(t reflect.Type) (fieldList, error) {
+	fs, err := defaultFieldCache.fields(t)
+	if err != nil {
+		return nil, err
 	}
-	sv := rv.Elem().FieldByName("Model") // TODO: ensure this is a calcifer.Model?
-	if sv.Kind() != reflect.Struct {
-		return errors.New("calcifer: missing Model field on foreign key reference object")
+	if err := e.check(t, fs, ""); err != nil {
+		return nil, err
 	}
-	sv = sv.FieldByName("ID")
-	id := sv.String()
-	if id == "" {
-		return nil // empty field, no ID to expand
+	var refs fieldList
+	for _, f := range fs {
+		if f.TagOptions.reference != "" && e.field(f.Name) != nil {
+			refs = append(refs, f)
+		}
 	}
-	ref := tx.cli.Collection(col).Doc(id)
-	return tx.Get(ref, rv.Interface().(MutableModel))
+	return refs, nil
 }
 
-func (tx *Transaction) expandModel(m MutableModel) error {
-	v := reflect.ValueOf(m)
-	if v.Kind() == reflect.Pointer {
-		if v.IsNil() {
-			return nil // no model to expand
+// DefaultMaxExpandDepth is the maximum expansion depth of reads without a
+// MaxExpandDepth option.
+const DefaultMaxExpandDepth = 10
+
+// MaxExpandDepth returns a ReadOption that limits the depth to which references
+// are expanded: the reference fields of the models read are at depth 1, those of
+// the models they refer to at depth 2, and so on. References beyond the maximum
+// depth are handled according to the read's DepthPolicy. MaxExpandDepth(0)
+// expands nothing, as NoExpand does, whatever the DepthPolicy.
+func MaxExpandDepth(n int) ReadOption {
+	if n < 0 {
+		n = 0
+	}
+	return maxExpandDepth(n)
+}
+
+type maxExpandDepth int
+
+func (n maxExpandDepth) applyRead(c *readConfig) { c.maxDepth = int(n) }
+
+// A DepthPolicy is a ReadOption that determines what happens to references
+// beyond the maximum expansion depth of a read; see MaxExpandDepth.
+type DepthPolicy int
+
+const (
+	// TruncateAtMaxDepth leaves references beyond the maximum depth unexpanded,
+	// with only their IDs set. It is the default.
+	TruncateAtMaxDepth DepthPolicy = iota
+	// FailBeyondMaxDepth makes reads that would expand a reference beyond the
+	// maximum depth fail with an *ExpandDepthError.
+	FailBeyondMaxDepth
+)
+
+func (p DepthPolicy) applyRead(c *readConfig) { c.depthPolicy = p }
+
+// A MissingPolicy determines what happens to references to documents that don't
+// exist when they are expanded. The policy of a read applies to reference fields
+// without an "onmissing=" tag option, which names the policy of its field: one of
+// "error", "keep-id", "nil" and "drop". A MissingPolicy is a ReadOption that sets
+// the policy of a read.
+type MissingPolicy int
+
+const (
+	// FailOnMissing, or onmissing=error, makes the read fail. It is the default.
+	FailOnMissing MissingPolicy = iota
+	// KeepMissingID, or onmissing=keep-id, leaves the referenced model with
+	// only its ID set.
+	KeepMissingID
+	// NilMissing, or onmissing=nil, sets the reference to nil, or to the zero
+	// model in slices and maps of models.
+	NilMissing
+	// DropMissing, or onmissing=drop, removes the reference from its slice or
+	// map. Other references are set to nil.
+	DropMissing
+)
+
+// missingPolicies maps the values of the "onmissing=" tag option to policies.
+var missingPolicies = map[string]MissingPolicy{
+	"error":   FailOnMissing,
+	"keep-id": KeepMissingID,
+	"nil":     NilMissing,
+	"drop":    DropMissing,
+}
+
+func (p MissingPolicy) applyRead(c *readConfig) { c.missing = p }
+
+// A MissingReference is a reference to a document that doesn't exist, found by
+// a read; see ReportMissing.
+type MissingReference struct {
+	Document string // full path of the document holding the reference
+	Field    string // calcifer path of the reference in the document, such as "attendees.2"
+	Path     string // full path of the missing document
+}
+
+// ReportMissing returns a ReadOption that makes a read append to *refs the
+// references to documents that don't exist that it skips, as allowed by its
+// MissingPolicy or by the tag options of their fields.
+func ReportMissing(refs *[]MissingReference) ReadOption {
+	return reportMissing{refs}
+}
+
+type reportMissing struct {
+	refs *[]MissingReference
+}
+
+func (r reportMissing) applyRead(c *readConfig) { c.report = r.refs }
+
+// An expander reads the documents referred to by the models of a single read.
+// It works level by level: the references of the models read are at depth 1,
+// those of the models they refer to at depth 2, and so on, and the documents of
+// each level are fetched with one batch read per collection.
+//
+// Each document is read at most once into each type and selection of fields:
+// further references to it, including those that form cycles, are given the
+// model already read. Reference fields holding pointers share the model; slices
+// and maps of models hold copies of it, made once the read is complete.
+//
+// Map elements cannot be set in place, so references in maps are expanded into
+// copies of their elements, which are stored back once the read is complete.
+type expander struct {
+	// fetch reads the documents referred to by refs, which are in the same
+	// collection, returning nil for those that don't exist.
+	fetch    func(ctx context.Context, refs []*firestore.DocumentRef) ([]*firestore.DocumentSnapshot, error)
+	decode   func(ctx context.Context, m MutableModel, doc *firestore.DocumentSnapshot) error
+	cli      *Client
+	maxDepth int
+	policy   DepthPolicy
+	missing  MissingPolicy
+	report   *[]MissingReference
+	loaded   map[loadKey]reflect.Value // pointers to the models read
+	copies   []modelCopy               // copies to make once the read is complete
+	entries  []*mapEntry               // map elements to store once the read is complete
+}
+
+// A loadKey identifies a model read by an expander.
+type loadKey struct {
+	path string       // path of the document
+	typ  reflect.Type // pointer to the model type
+	sel  *expansion   // fields of the model to expand
+}
+
+// A modelCopy copies a model read by an expander into an element of a slice.
+type modelCopy struct {
+	dst reflect.Value // slice element
+	src reflect.Value // pointer to the model
+}
+
+// A mapEntry is a copy of an element of a map of references.
+type mapEntry struct {
+	m, key reflect.Value
+	v      reflect.Value // copy of the element
+	drop   bool          // whether to delete the element instead
+}
+
+// newExpander returns an expander for a read with configuration rc outside of
+// transactions.
+func (c *Client) newExpander(rc *readConfig) *expander {
+	return &expander{
+		fetch: func(ctx context.Context, refs []*firestore.DocumentRef) ([]*firestore.DocumentSnapshot, error) {
+			docs, err := c.fs.GetAll(ctx, refs)
+			if err != nil {
+				return nil, err
+			}
+			return existing(docs), nil
+		},
+		decode: func(_ context.Context, m MutableModel, doc *firestore.DocumentSnapshot) error {
+			return c.docToModel(m, doc)
+		},
+		cli:      c,
+		maxDepth: rc.maxDepth,
+		policy:   rc.depthPolicy,
+		missing:  rc.missing,
+		report:   rc.report,
+		loaded:   make(map[loadKey]reflect.Value),
+	}
+}
+
+// newExpander returns an expander for a read with configuration rc in tx, which
+// reads the referenced documents in tx too.
+func (tx *Transaction) newExpander(rc *readConfig) *expander {
+	e := tx.cli.newExpander(rc)
+	e.fetch = func(_ context.Context, refs []*firestore.DocumentRef) ([]*firestore.DocumentSnapshot, error) {
+		docs, err := tx.tx.GetAll(refs)
+		if err != nil {
+			return nil, err
+		}
+		return existing(docs), nil
+	}
+	e.decode = func(_ context.Context, m MutableModel, doc *firestore.DocumentSnapshot) error {
+		return tx.cli.docToModel(m, doc)
+	}
+	return e
+}
+
+// existing replaces the snapshots in docs of documents that don't exist by nil.
+func existing(docs []*firestore.DocumentSnapshot) []*firestore.DocumentSnapshot {
+	for i, doc := range docs {
+		if !doc.Exists() {
+			docs[i] = nil
 		}
-		v = v.Elem()
 	}
-	fs, err := defaultFieldCache.fields(v.Type())
+	return docs
+}
+
+// A pendingRef is a reference whose document is yet to be read.
+type pendingRef struct {
+	rv      reflect.Value // reference field, or element of one, holding the model
+	mv      reflect.Value // pointer to the model
+	ref     *firestore.DocumentRef
+	sel     *expansion    // fields of the model to expand
+	depth   int           // depth of the reference
+	missing MissingPolicy // what to do if the document doesn't exist
+	slice   reflect.Value // slice holding rv, if any
+	index   int           // index of rv in slice
+	entry   *mapEntry     // map element copied into rv, if any
+	holder  string        // path of the document holding the reference
+	field   string        // calcifer path of the reference in the holder
+}
+
+func (p *pendingRef) key() loadKey {
+	return loadKey{path: p.ref.Path, typ: p.mv.Type(), sel: p.sel}
+}
+
+// expand reads the references of m, which was read from doc, that sel selects.
+func (e *expander) expand(ctx context.Context, m MutableModel, doc *firestore.DocumentSnapshot, sel *expansion) error {
+	mv := reflect.ValueOf(m)
+	e.loaded[loadKey{path: doc.Ref.Path, typ: mv.Type(), sel: sel}] = mv
+	pending, err := e.collect(mv, doc.Ref.Path, sel, 1)
 	if err != nil {
 		return err
 	}
-	for _, f := range fs { // TODO: parallelize
-		col := f.TagOptions.reference
-		if col == "" {
-			continue
+	return e.expandLevels(ctx, pending)
+}
+
+// expandAll reads the references that sel selects of the models in the slice
+// models, which were read from docs.
+func (e *expander) expandAll(ctx context.Context, models reflect.Value, docs []*firestore.DocumentSnapshot, sel *expansion) error {
+	for i, doc := range docs {
+		mv := models.Index(i).Addr()
+		e.loaded[loadKey{path: doc.Ref.Path, typ: mv.Type(), sel: sel}] = mv
+	}
+	var pending []*pendingRef
+	for i := 0; i < models.Len(); i++ {
+		refs, err := e.collect(models.Index(i), docs[i].Ref.Path, sel, 1)
+		if err != nil {
+			return err
 		}
-		rv := v.FieldByIndex(f.Index)
-		if err := tx.expandField(rv, col); err != nil {
+		pending = append(pending, refs...)
+	}
+	return e.expandLevels(ctx, pending)
+}
+
+// expandLevels reads the documents of pending, then those that they refer to,
+// and so on, a level at a time.
+func (e *expander) expandLevels(ctx context.Context, pending []*pendingRef) error {
+	for len(pending) > 0 {
+		docs, err := e.fetchLevel(ctx, pending)
+		if err != nil {
 			return err
 		}
+		// Missing references are handled first, so that elements are dropped
+		// from their slices before any model in the slices is read.
+		var found, drops []*pendingRef
+		for _, p := range pending {
+			if docs[p.ref.Path] != nil {
+				found = append(found, p)
+				continue
+			}
+			drop, err := e.skipMissing(p)
+			if err != nil {
+				return err
+			}
+			if drop {
+				drops = append(drops, p)
+			}
+		}
+		e.dropElements(drops, found)
+		var read []*pendingRef
+		for _, p := range found {
+			ok, err := e.load(ctx, p, docs[p.ref.Path])
+			if err != nil {
+				return err
+			}
+			if ok {
+				read = append(read, p)
+			}
+		}
+		// The next level is collected once the whole of this one is read,
+		// so that references to its models are not read again.
+		pending = nil
+		for _, p := range read {
+			refs, err := e.collect(p.mv, p.ref.Path, p.sel, p.depth+1)
+			if err != nil {
+				return err
+			}
+			pending = append(pending, refs...)
+		}
+	}
+	// Copies are made deepest first, so that they include those made from them.
+	for i := len(e.copies) - 1; i >= 0; i-- {
+		e.copies[i].dst.Set(e.copies[i].src.Elem())
+	}
+	e.copies = nil
+	for _, el := range e.entries {
+		if el.drop {
+			el.m.SetMapIndex(el.key, reflect.Value{})
+		} else {
+			el.m.SetMapIndex(el.key, el.v)
+		}
 	}
+	e.entries = nil
 	return nil
 }
 
-func (c *Client) expandAll(ctx context.Context, p any) error {
-	modelSlice := reflect.ValueOf(p).Elem()
-	fs, err := defaultFieldCache.fields(modelSlice.Index(0).Type())
-	if err != nil {
-		return err
+// skipMissing handles p, which refers to a document that doesn't exist,
+// according to its MissingPolicy, reporting whether it is to be dropped from
+// its slice. Elements of maps are dropped by skipMissing itself.
+func (e *expander) skipMissing(p *pendingRef) (bool, error) {
+	drop := false
+	switch p.missing {
+	case FailOnMissing:
+		return false, fmt.Errorf("calcifer: unable to find doc with ID %q during expansion of collection %q", p.ref.ID, p.ref.Parent.ID)
+	case NilMissing:
+		p.rv.Set(reflect.Zero(p.rv.Type()))
+	case DropMissing:
+		switch {
+		case p.slice.IsValid():
+			drop = true
+		case p.entry != nil:
+			p.entry.drop = true
+		default:
+			p.rv.Set(reflect.Zero(p.rv.Type()))
+		}
 	}
-	refs := make([][]*firestore.DocumentRef, len(fs))
-	for fi, f := range fs {
-		if f.TagOptions.reference == "" {
-			continue
+	if e.report != nil {
+		*e.report = append(*e.report, MissingReference{Document: p.holder, Field: p.field, Path: p.ref.Path})
+	}
+	return drop, nil
+}
+
+// dropElements removes the elements of drops from their slices, in place,
+// shifting the elements that follow them. The references in found, and the
+// copies to be made, that are to elements of those slices are moved with them.
+// No model in the slices has been read yet, so nothing else refers to them.
+func (e *expander) dropElements(drops, found []*pendingRef) {
+	if len(drops) == 0 {
+		return
+	}
+	bySlice := make(map[uintptr]map[int]bool) // indexes to drop, by address of the slice
+	slices := make(map[uintptr]reflect.Value)
+	for _, p := range drops {
+		addr := p.slice.Addr().Pointer()
+		if bySlice[addr] == nil {
+			bySlice[addr] = make(map[int]bool)
+			slices[addr] = p.slice
 		}
-		refs[fi] = make([]*firestore.DocumentRef, modelSlice.Len())
-		for i := 0; i < modelSlice.Len(); i++ {
-			rv := modelSlice.Index(i).FieldByIndex(fs[fi].Index)
-			sv := rv.Elem().FieldByName("Model") // TODO: ensure this is a calcifer.Model?
-			if sv.Kind() != reflect.Struct {
-				return errors.New("calcifer: missing Model field on foreign key reference object")
+		bySlice[addr][p.index] = true
+	}
+	type element struct {
+		v     reflect.Value
+		index int
+	}
+	moved := make(map[uintptr]element) // new elements, by address of the old ones
+	for addr, indexes := range bySlice {
+		s := slices[addr]
+		n := 0
+		for i := 0; i < s.Len(); i++ {
+			if indexes[i] {
+				continue
 			}
-			sv = sv.FieldByName("ID")
-			id := sv.String()
-			if id == "" {
-				continue // empty field, no ID to expand | TODO, ok if we GetAll with this in the slice?
+			if i != n {
+				moved[s.Index(i).Addr().Pointer()] = element{s.Index(n), n}
+				s.Index(n).Set(s.Index(i))
 			}
-			refs[fi][i] = c.Collection(f.TagOptions.reference).cref.Doc(id)
+			n++
+		}
+		for i := n; i < s.Len(); i++ {
+			s.Index(i).Set(reflect.Zero(s.Type().Elem()))
 		}
+		s.Set(s.Slice(0, n))
 	}
-	g, gctx := errgroup.WithContext(ctx)
-	for fi, f := range fs {
-		if f.TagOptions.reference == "" {
+	for _, p := range found {
+		if !p.slice.IsValid() {
+			continue
+		}
+		if el, ok := moved[p.rv.Addr().Pointer()]; ok {
+			p.rv, p.index = el.v, el.index
+			if el.v.Kind() != reflect.Pointer {
+				p.mv = el.v.Addr()
+			}
+		}
+	}
+	for i, c := range e.copies {
+		if el, ok := moved[c.dst.Addr().Pointer()]; ok {
+			e.copies[i].dst = el.v
+		}
+	}
+}
+
+// fetchLevel reads the documents of pending, with one batch read per collection,
+// in parallel. It returns them by path, with nil for those that don't exist.
+func (e *expander) fetchLevel(ctx context.Context, pending []*pendingRef) (map[string]*firestore.DocumentSnapshot, error) {
+	docs := make(map[string]*firestore.DocumentSnapshot)
+	batches := make(map[string][]*firestore.DocumentRef) // by collection path
+	for _, p := range pending {
+		if _, ok := docs[p.ref.Path]; ok {
 			continue
 		}
-		fi := fi
+		docs[p.ref.Path] = nil
+		col := p.ref.Parent.Path
+		batches[col] = append(batches[col], p.ref)
+	}
+	var mu sync.Mutex
+	g, gctx := errgroup.WithContext(ctx)
+	for _, refs := range batches {
+		refs := refs
 		g.Go(func() error {
-			docs, err := c.fs.GetAll(gctx, refs[fi])
+			snaps, err := e.fetch(gctx, refs)
 			if err != nil {
 				return err
 			}
-			for i, doc := range docs {
-				if refs[fi][i] != nil {
-					if !doc.Exists() {
-						return fmt.Errorf("calcifer: unable to find doc with ID %q during expansion of collection %q", refs[fi][i].ID, fs[fi].TagOptions.reference)
-					}
-					if err := docToModel(modelSlice.Index(i).FieldByIndex(fs[fi].Index).Interface().(MutableModel), doc); err != nil {
-						return err
-					}
-				}
+			mu.Lock()
+			defer mu.Unlock()
+			for i, ref := range refs {
+				docs[ref.Path] = snaps[i]
 			}
 			return nil
 		})
 	}
-	return g.Wait()
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// collect returns the reads needed to expand the references of the model v, read
+// from the document at path holder, that sel selects, which are at the given
+// depth.
+func (e *expander) collect(v reflect.Value, holder string, sel *expansion, depth int) ([]*pendingRef, error) {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return nil, nil // no model to expand
+		}
+		v = v.Elem()
+	}
+	fs, err := sel.expandedFields(v.Type())
+	if err != nil {
+		return nil, err
+	}
+	var pending []*pendingRef
+	// add adds the read of rv, if needed, and returns it; elem is the slice
+	// index or map key of rv, if any.
+	add := func(rv reflect.Value, f field, elem string) (*pendingRef, error) {
+		p, err := e.lookup(rv, f.TagOptions.reference, sel.field(f.Name), depth)
+		if p == nil {
+			return nil, err
+		}
+		p.missing = e.missing
+		if f.TagOptions.hasOnMissing {
+			p.missing = f.TagOptions.onMissing
+		}
+		p.holder, p.field = holder, f.Name
+		if elem != "" {
+			p.field += "." + elem
+		}
+		pending = append(pending, p)
+		return p, nil
+	}
+	for _, f := range fs {
+		rv := v.FieldByIndex(f.Index)
+		switch rv.Kind() {
+		case reflect.Slice:
+			for i := 0; i < rv.Len(); i++ {
+				p, err := add(rv.Index(i), f, strconv.Itoa(i))
+				if err != nil {
+					return nil, err
+				}
+				if p != nil {
+					p.slice, p.index = rv, i
+				}
+			}
+		case reflect.Map:
+			keys := rv.MapKeys()
+			sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+			for _, k := range keys {
+				el := &mapEntry{m: rv, key: k, v: reflect.New(rv.Type().Elem()).Elem()}
+				el.v.Set(rv.MapIndex(k))
+				e.entries = append(e.entries, el)
+				p, err := add(el.v, f, k.String())
+				if err != nil {
+					return nil, err
+				}
+				if p != nil {
+					p.entry = el
+				}
+			}
+		case reflect.Pointer:
+			if _, err := add(rv, f, ""); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errors.New("calcifer: trying to expand into non-pointer field")
+		}
+	}
+	return pending, nil
+}
+
+// lookup returns the read needed to expand the model referred to by rv, a
+// pointer to a model or an element of a slice or map of models, to collection col. It
+// returns nil if rv refers to no document, to one already read, or to one beyond
+// the maximum depth that is not to fail the read.
+func (e *expander) lookup(rv reflect.Value, col string, sel *expansion, depth int) (*pendingRef, error) {
+	mv := rv
+	if rv.Kind() != reflect.Pointer {
+		mv = rv.Addr()
+	} else if rv.IsNil() {
+		return nil, nil
+	}
+	sv := mv.Elem().FieldByName("Model")
+	if sv.Kind() != reflect.Struct {
+		return nil, errors.New("calcifer: missing Model field on foreign key reference object")
+	}
+	id := sv.FieldByName("ID").String()
+	if id == "" {
+		return nil, nil // empty field, no ID to expand
+	}
+	p := &pendingRef{rv: rv, mv: mv, ref: e.cli.fs.Collection(col).Doc(id), sel: sel, depth: depth}
+	if e.reuse(p) {
+		return nil, nil
+	}
+	if depth > e.maxDepth {
+		if e.policy == TruncateAtMaxDepth || e.maxDepth == 0 {
+			return nil, nil
+		}
+		return nil, &ExpandDepthError{Path: p.ref.Path, MaxDepth: e.maxDepth}
+	}
+	return p, nil
+}
+
+// reuse gives p the model already read for it, if there is one.
+func (e *expander) reuse(p *pendingRef) bool {
+	mv, ok := e.loaded[p.key()]
+	if !ok {
+		return false
+	}
+	if p.rv.Kind() == reflect.Pointer {
+		p.rv.Set(mv)
+	} else {
+		e.copies = append(e.copies, modelCopy{dst: p.rv, src: mv})
+	}
+	return true
+}
+
+// load populates the model of p from doc, reporting whether it did so rather
+// than reuse a model already read.
+func (e *expander) load(ctx context.Context, p *pendingRef, doc *firestore.DocumentSnapshot) (bool, error) {
+	if e.reuse(p) { // read more than once in a level
+		return false, nil
+	}
+	if err := e.decode(ctx, p.mv.Interface().(MutableModel), doc); err != nil {
+		return false, err
+	}
+	e.loaded[p.key()] = p.mv
+	return true, nil
 }
@@ -0,0 +1,368 @@
+// Copyright 2022 Radiopaper Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calcifer
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/firestore"
+	"github.com/stretchr/testify/assert"
+)
+
+type friend struct {
+	Model
+
+	Name   string   `calcifer:"name"`
+	Best   *friend  `calcifer:"best,ref:friends"`
+	Others []friend `calcifer:"others,ref:friends"`
+}
+
+// A fakeStore maps the paths of documents in top-level collections, such as
+// "users/bilbo", to functions returning the models stored in them.
+type fakeStore map[string]func() MutableModel
+
+// fakeCounts counts the reads made from a fakeStore.
+type fakeCounts struct {
+	sync.Mutex
+	roundTrips int // batch reads
+	docs       int // documents read
+}
+
+// fakeExpander returns an expander that reads documents from s rather than from
+// Firestore, and the counts of its reads.
+func fakeExpander(t *testing.T, s fakeStore, opts ...ReadOption) (*expander, *fakeCounts) {
+	counts := &fakeCounts{}
+	e := offlineClient(t).newExpander(newReadConfig(opts))
+	e.fetch = func(_ context.Context, refs []*firestore.DocumentRef) ([]*firestore.DocumentSnapshot, error) {
+		counts.Lock()
+		defer counts.Unlock()
+		counts.roundTrips++
+		docs := make([]*firestore.DocumentSnapshot, len(refs))
+		for i, ref := range refs {
+			if ref.Parent.Path != refs[0].Parent.Path {
+				t.Errorf("batch read of %s and %s", refs[0].Path, ref.Path)
+			}
+			if _, ok := s[ref.Parent.ID+"/"+ref.ID]; ok {
+				docs[i] = &firestore.DocumentSnapshot{Ref: ref}
+				counts.docs++
+			}
+		}
+		return docs, nil
+	}
+	e.decode = func(_ context.Context, m MutableModel, doc *firestore.DocumentSnapshot) error {
+		reflect.ValueOf(m).Elem().Set(reflect.ValueOf(s[doc.Ref.Parent.ID+"/"+doc.Ref.ID]()).Elem())
+		return nil
+	}
+	return e, counts
+}
+
+// readFake reads the document at path into m with e, as DocumentRef.Get does,
+// expanding the fields selected by opts.
+func readFake(e *expander, path string, m MutableModel, opts ...ReadOption) error {
+	parts := strings.Split(path, "/")
+	doc := &firestore.DocumentSnapshot{Ref: e.cli.fs.Collection(parts[0]).Doc(parts[1])}
+	if err := e.decode(context.Background(), m, doc); err != nil {
+		return err
+	}
+	return e.expand(context.Background(), m, doc, newReadConfig(opts).expand)
+}
+
+// friendGraph maps the IDs of friends to those of their best friends and others.
+type friendGraph map[string][]string
+
+func (g friendGraph) store() fakeStore {
+	s := make(fakeStore)
+	for id, ids := range g {
+		id, ids := id, ids
+		s["friends/"+id] = func() MutableModel {
+			f := &friend{Model: Model{ID: id}, Name: id}
+			if len(ids) > 0 && ids[0] != "" {
+				f.Best = &friend{Model: Model{ID: ids[0]}}
+			}
+			for i := 1; i < len(ids); i++ {
+				f.Others = append(f.Others, friend{Model: Model{ID: ids[i]}})
+			}
+			return f
+		}
+	}
+	return s
+}
+
+// readFriend reads the friend with the given ID with e.
+func readFriend(e *expander, id string) (*friend, error) {
+	f := &friend{}
+	return f, readFake(e, "friends/"+id, f)
+}
+
+func TestExpansionCycles(t *testing.T) {
+	e, counts := fakeExpander(t, friendGraph{"narcissus": {"narcissus"}}.store())
+	f, err := readFriend(e, "narcissus")
+	assert.NoError(t, err)
+	assert.True(t, f == f.Best)
+	assert.Equal(t, 0, counts.docs)
+
+	e, counts = fakeExpander(t, friendGraph{"frodo": {"sam", "merry", "pippin"}, "sam": {"frodo", "rosie"}, "rosie": {"sam"}, "merry": {"pippin", "frodo"}, "pippin": {"merry", "frodo"}}.store())
+	f, err = readFriend(e, "frodo")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, counts.docs) // each friend once
+	assert.Equal(t, "sam", f.Best.Name)
+	assert.True(t, f == f.Best.Best)
+	assert.True(t, f.Best == f.Best.Others[0].Best)
+	assert.Equal(t, "merry", f.Others[0].Name)
+	assert.Equal(t, "pippin", f.Others[1].Name)
+	assert.True(t, &f.Others[1] == f.Others[0].Best)
+	assert.True(t, &f.Others[0] == f.Others[1].Best)
+	assert.Equal(t, "frodo", f.Others[0].Others[0].Name) // a copy of f
+	assert.Equal(t, "sam", f.Others[0].Others[0].Best.Name)
+}
+
+func TestExpansionDepth(t *testing.T) {
+	chain := friendGraph{"1": {"2"}, "2": {"3"}, "3": {"4"}, "4": {"5"}, "5": nil}.store()
+
+	e, counts := fakeExpander(t, chain)
+	f, err := readFriend(e, "1")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, counts.docs)
+	assert.Equal(t, "5", f.Best.Best.Best.Best.Name)
+
+	e, _ = fakeExpander(t, chain, MaxExpandDepth(2), FailBeyondMaxDepth)
+	_, err = readFriend(e, "1")
+	var depthErr *ExpandDepthError
+	if assert.ErrorAs(t, err, &depthErr) {
+		assert.Equal(t, 2, depthErr.MaxDepth)
+		assert.Equal(t, e.cli.fs.Collection("friends").Doc("4").Path, depthErr.Path)
+	}
+
+	e, counts = fakeExpander(t, chain, MaxExpandDepth(2))
+	f, err = readFriend(e, "1")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, counts.docs)
+	assert.Equal(t, "3", f.Best.Best.Name)
+	assert.Equal(t, "4", f.Best.Best.Best.ID)
+	assert.Empty(t, f.Best.Best.Best.Name)
+
+	// Chains longer than the default maximum depth are truncated.
+	long := friendGraph{}
+	for i := 1; i < 15; i++ {
+		long[strconv.Itoa(i)] = []string{strconv.Itoa(i + 1)}
+	}
+	e, counts = fakeExpander(t, long.store())
+	f, err = readFriend(e, "1")
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultMaxExpandDepth, counts.docs)
+
+	// A maximum depth of 0 expands nothing, as NoExpand does.
+	e, counts = fakeExpander(t, chain, MaxExpandDepth(0), FailBeyondMaxDepth)
+	f, err = readFriend(e, "1")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, counts.docs)
+	assert.Equal(t, "2", f.Best.ID)
+	assert.Empty(t, f.Best.Name)
+
+	// References that form cycles are not beyond the maximum depth.
+	e, counts = fakeExpander(t, friendGraph{"a": {"b"}, "b": {"a"}}.store(), MaxExpandDepth(1))
+	f, err = readFriend(e, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, counts.docs)
+	assert.True(t, f == f.Best.Best)
+}
+
+func TestBatchedExpansion(t *testing.T) {
+	user := func(id string) func() MutableModel {
+		return func() MutableModel { return &User{Model: Model{ID: id}, Email: id + "@example.com"} }
+	}
+	store := fakeStore{
+		"users/bilbo":   user("bilbo"),
+		"users/gandalf": user("gandalf"),
+		"users/thorin":  user("thorin"),
+		"users/elrond":  user("elrond"),
+		"halls/bagend": func() MutableModel {
+			return &hall{Model: Model{ID: "bagend"}, Name: "Bag End", Owner: &User{Model: Model{ID: "bilbo"}}}
+		},
+		"halls/rivendell": func() MutableModel {
+			return &hall{Model: Model{ID: "rivendell"}, Name: "Rivendell", Owner: &User{Model: Model{ID: "elrond"}}}
+		},
+		"parties/unexpected": func() MutableModel {
+			return &party{
+				Model:  Model{ID: "unexpected"},
+				Hall:   &hall{Model: Model{ID: "bagend"}},
+				Guests: []User{{Model: Model{ID: "bilbo"}}, {Model: Model{ID: "gandalf"}}, {Model: Model{ID: "thorin"}}},
+			}
+		},
+		"parties/council": func() MutableModel {
+			return &party{
+				Model:  Model{ID: "council"},
+				Hall:   &hall{Model: Model{ID: "rivendell"}},
+				Guests: []User{{Model: Model{ID: "gandalf"}}, {Model: Model{ID: "bilbo"}}},
+			}
+		},
+	}
+
+	// One batch per collection and level: the hall and guests, then the owner
+	// of the hall, who is one of the guests.
+	e, counts := fakeExpander(t, store)
+	var p party
+	assert.NoError(t, readFake(e, "parties/unexpected", &p))
+	assert.Equal(t, 2, counts.roundTrips)
+	assert.Equal(t, 4, counts.docs)
+	assert.Equal(t, "Bag End", p.Hall.Name)
+	assert.Equal(t, "thorin@example.com", p.Guests[2].Email)
+	assert.True(t, &p.Guests[0] == p.Hall.Owner)
+
+	e, counts = fakeExpander(t, store)
+	p = party{}
+	assert.NoError(t, readFake(e, "parties/unexpected", &p, Expand("hall")))
+	assert.Equal(t, 1, counts.roundTrips)
+	assert.Equal(t, "Bag End", p.Hall.Name)
+	assert.Empty(t, p.Hall.Owner.Email)
+	assert.Empty(t, p.Guests[0].Email)
+
+	// All the models of a GetAll are expanded together.
+	e, counts = fakeExpander(t, store)
+	ps := []party{{}, {}}
+	var docs []*firestore.DocumentSnapshot
+	for i, id := range []string{"unexpected", "council"} {
+		doc := &firestore.DocumentSnapshot{Ref: e.cli.fs.Collection("parties").Doc(id)}
+		assert.NoError(t, e.decode(context.Background(), &ps[i], doc))
+		docs = append(docs, doc)
+	}
+	assert.NoError(t, e.expandAll(context.Background(), reflect.ValueOf(ps), docs, expandEverything))
+	assert.Equal(t, 3, counts.roundTrips) // halls, guests, and the owner of Rivendell
+	assert.Equal(t, 6, counts.docs)
+	assert.Equal(t, "Rivendell", ps[1].Hall.Name)
+	assert.Equal(t, "elrond@example.com", ps[1].Hall.Owner.Email)
+	assert.Equal(t, "gandalf@example.com", ps[1].Guests[0].Email)
+	assert.Equal(t, "bilbo@example.com", ps[1].Guests[1].Email)
+
+	e, _ = fakeExpander(t, friendGraph{"lonely": {"nobody"}}.store())
+	_, err := readFriend(e, "lonely")
+	assert.ErrorContains(t, err, `unable to find doc with ID "nobody"`)
+}
+
+type guestList struct {
+	Model
+
+	Host    *User   `calcifer:"host,ref:users,onmissing=keep-id"`
+	Guests  []User  `calcifer:"guests,ref:users,onmissing=drop"`
+	Backups []*User `calcifer:"backups,ref:users"`
+}
+
+func TestMissingReferences(t *testing.T) {
+	store := fakeStore{
+		"users/bilbo": func() MutableModel { return &User{Model: Model{ID: "bilbo"}, Email: "bilbo@theshire.net"} },
+		"lists/party": func() MutableModel {
+			return &guestList{
+				Model:   Model{ID: "party"},
+				Host:    &User{Model: Model{ID: "smaug"}},
+				Guests:  []User{{Model: Model{ID: "smaug"}}, {Model: Model{ID: "bilbo"}}, {Model: Model{ID: "smaug"}}},
+				Backups: []*User{{Model: Model{ID: "smaug"}}, {Model: Model{ID: "bilbo"}}},
+			}
+		},
+	}
+
+	e, _ := fakeExpander(t, store)
+	err := readFake(e, "lists/party", &guestList{})
+	assert.ErrorContains(t, err, `unable to find doc with ID "smaug" during expansion of collection "users"`)
+
+	var missing []MissingReference
+	e, _ = fakeExpander(t, store, NilMissing, ReportMissing(&missing))
+	var l guestList
+	assert.NoError(t, readFake(e, "lists/party", &l))
+	assert.Equal(t, "smaug", l.Host.ID) // by its tag option
+	if assert.Len(t, l.Guests, 1) {
+		assert.Equal(t, "bilbo@theshire.net", l.Guests[0].Email)
+	}
+	assert.Nil(t, l.Backups[0])
+	assert.Equal(t, "bilbo@theshire.net", l.Backups[1].Email)
+	party := e.cli.fs.Collection("lists").Doc("party").Path
+	smaug := e.cli.fs.Collection("users").Doc("smaug").Path
+	assert.Equal(t, []MissingReference{
+		{Document: party, Field: "host", Path: smaug},
+		{Document: party, Field: "guests.0", Path: smaug},
+		{Document: party, Field: "guests.2", Path: smaug},
+		{Document: party, Field: "backups.0", Path: smaug},
+	}, missing)
+
+	e, _ = fakeExpander(t, store, DropMissing)
+	l = guestList{}
+	assert.NoError(t, readFake(e, "lists/party", &l))
+	if assert.Len(t, l.Backups, 1) {
+		assert.Equal(t, "bilbo@theshire.net", l.Backups[0].Email)
+	}
+
+	// Copies of models are made from them once their slices are compacted.
+	e, _ = fakeExpander(t, friendGraph{"a": {"b", "ghost", "b"}, "b": {"", "ghost2"}}.store(), DropMissing)
+	f, err := readFriend(e, "a")
+	assert.NoError(t, err)
+	assert.Empty(t, f.Best.Others)
+	if assert.Len(t, f.Others, 1) {
+		assert.Equal(t, "b", f.Others[0].Name)
+		assert.Empty(t, f.Others[0].Others)
+	}
+
+	// References to models in compacted slices refer to them where they end up.
+	e, _ = fakeExpander(t, friendGraph{"a": {"", "ghost", "c"}, "c": {"d"}, "d": {"c"}}.store(), DropMissing)
+	f, err = readFriend(e, "a")
+	assert.NoError(t, err)
+	if assert.Len(t, f.Others, 1) {
+		assert.Equal(t, "c", f.Others[0].Name)
+		assert.True(t, &f.Others[0] == f.Others[0].Best.Best)
+	}
+}
+
+type roster struct {
+	Model
+
+	Roles map[string]User  `calcifer:"roles,ref:users,onmissing=nil"`
+	Leads map[string]*User `calcifer:"leads,ref:users,onmissing=drop"`
+}
+
+func TestMapExpansion(t *testing.T) {
+	store := fakeStore{
+		"users/bilbo":   func() MutableModel { return &User{Model: Model{ID: "bilbo"}, Email: "bilbo@theshire.net"} },
+		"users/gandalf": func() MutableModel { return &User{Model: Model{ID: "gandalf"}, Email: "gandalf@middle-earth.org"} },
+		"rosters/fellowship": func() MutableModel {
+			return &roster{
+				Model: Model{ID: "fellowship"},
+				Roles: map[string]User{"burglar": {Model: Model{ID: "bilbo"}}, "wizard": {Model: Model{ID: "gandalf"}}, "dragon": {Model: Model{ID: "smaug"}}},
+				Leads: map[string]*User{"first": {Model: Model{ID: "gandalf"}}, "second": {Model: Model{ID: "smaug"}}},
+			}
+		},
+	}
+	var missing []MissingReference
+	e, counts := fakeExpander(t, store, ReportMissing(&missing))
+	var r roster
+	assert.NoError(t, readFake(e, "rosters/fellowship", &r))
+	assert.Equal(t, 1, counts.roundTrips)
+	assert.Equal(t, map[string]User{
+		"burglar": {Model: Model{ID: "bilbo"}, Email: "bilbo@theshire.net"},
+		"wizard":  {Model: Model{ID: "gandalf"}, Email: "gandalf@middle-earth.org"},
+		"dragon":  {},
+	}, r.Roles)
+	if assert.Len(t, r.Leads, 1) {
+		assert.Equal(t, "gandalf@middle-earth.org", r.Leads["first"].Email)
+	}
+	fellowship := e.cli.fs.Collection("rosters").Doc("fellowship").Path
+	smaug := e.cli.fs.Collection("users").Doc("smaug").Path
+	assert.Equal(t, []MissingReference{
+		{Document: fellowship, Field: "roles.dragon", Path: smaug},
+		{Document: fellowship, Field: "leads.second", Path: smaug},
+	}, missing)
+}
@@ -40,6 +40,10 @@ func MustRegisterModel(m ReadableModel) {
 	}
 }
 
+// RegisterModel checks that the type of m, and the types that it nests or refers
+// to, can be stored in Firestore, returning a *ModelTypeError that lists every
+// problem found otherwise. Models need not be registered, but registering them
+// at startup reports such problems before any document is read or written.
 func RegisterModel(m ReadableModel) error {
 	_, err := defaultFieldCache.fields(reflect.TypeOf(m))
 	return err
@@ -57,16 +61,47 @@ type field struct {
 }
 type fieldList []field
 
+// byName returns the field whose effective name is name.
+func (l fieldList) byName(name string) (field, bool) {
+	for _, f := range l {
+		if f.Name == name && !f.TagOptions.remain {
+			return f, true
+		}
+	}
+	return field{}, false
+}
+
+type fieldByNameKey struct {
+	t    reflect.Type
+	name string
+}
+
+var fieldIndexCache sync.Map // from fieldByNameKey to []int
+
+// fieldByName returns the struct field of v with the given name, like
+// v.FieldByName, but remembers where the field is in v's type.
+func fieldByName(v reflect.Value, name string) reflect.Value {
+	key := fieldByNameKey{v.Type(), name}
+	x, ok := fieldIndexCache.Load(key)
+	if !ok {
+		var index []int
+		if f, found := v.Type().FieldByName(name); found {
+			index = f.Index
+		}
+		x, _ = fieldIndexCache.LoadOrStore(key, index)
+	}
+	index := x.([]int)
+	if index == nil {
+		return reflect.Value{}
+	}
+	return v.FieldByIndex(index)
+}
+
 type cacheValue struct {
 	fields fieldList
 	err    error
 }
 
-func validate(t reflect.Type) error {
-	return nil
-	// return errors.New("validate: unimplemented")
-}
-
 func (c *fieldCache) fields(t reflect.Type) (fieldList, error) {
 	if t.Kind() == reflect.Pointer {
 		t = t.Elem()
@@ -90,23 +125,27 @@ func (c *fieldCache) fields(t reflect.Type) (fieldList, error) {
 	return cv.fields, cv.err
 }
 
+// typeFields lists the fields of t, which must have passed validate.
 func (c *fieldCache) typeFields(t reflect.Type) ([]field, error) {
-	fields, err := listFields(t)
-	if err != nil {
-		return nil, err
-	}
+	return listFields(t)
+}
 
-	fs := make(map[string]struct{})
-	for _, f := range fields {
-		if _, ok := fs[f.Name]; ok {
-			return nil, fmt.Errorf("calcifer: duplicate field %q", f.Name)
+func listFields(t reflect.Type) ([]field, error) {
+	var tagErr error
+	fields := scanFields(t, func(index []int, err error) {
+		if tagErr == nil {
+			tagErr = fmt.Errorf("calcifer: field %s of %s: %v", goFieldPath(t, index), t, err)
 		}
-		fs[f.Name] = struct{}{}
+	})
+	if tagErr != nil {
+		return nil, tagErr
 	}
 	return fields, nil
 }
 
-func listFields(t reflect.Type) ([]field, error) {
+// scanFields lists the fields of t, reporting each field whose tag cannot be
+// parsed to badTag and leaving it out.
+func scanFields(t reflect.Type, badTag func(index []int, err error)) []field {
 	// This uses the same condition that the Go language does: there must be a unique instance
 	// of the match at a given depth level. If there are multiple instances of a match at the
 	// same depth, they annihilate each other and inhibit any possible match at a lower level.
@@ -168,7 +207,8 @@ func listFields(t reflect.Type) ([]field, error) {
 				// Examine the tag.
 				tagName, keep, options, err := parseTag(f.Tag)
 				if err != nil {
-					return nil, err
+					badTag(append(append([]int(nil), scan.index...), i), err)
+					continue
 				}
 				if !keep {
 					continue
@@ -222,7 +262,22 @@ func listFields(t reflect.Type) ([]field, error) {
 			}
 		}
 	}
-	return fields, nil
+	return fields
+}
+
+// goFieldPath returns the dot-separated Go names of the fields that lead to the
+// field of struct type t with the given index sequence.
+func goFieldPath(t reflect.Type, index []int) string {
+	names := make([]string, len(index))
+	for i, x := range index {
+		if t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		f := t.Field(x)
+		names[i] = f.Name
+		t = f.Type
+	}
+	return strings.Join(names, ".")
 }
 
 func newField(f reflect.StructField, tagName string, options *tagOptions, index []int, i int) field {
@@ -249,26 +304,91 @@ type fieldScan struct {
 	index []int
 }
 
+// isLeafType reports whether values of type t are stored as single Firestore
+// values rather than as maps of their fields. Firestore's own value types are
+// used by pointer, but their struct types are leaves too, so they are never
+// descended into.
 func isLeafType(t reflect.Type) bool {
-	return t == typeOfGoTime /*|| t == typeOfLatLng || t == typeOfProtoTimestamp */
+	if t == typeOfGoTime || hasMarshalOrUnmarshalMethod(t) {
+		return true
+	}
+	if t.Kind() != reflect.Pointer {
+		t = reflect.PointerTo(t)
+	}
+	return t == typeOfLatLng || t == typeOfProtoTimestamp || t == typeOfFirestoreDocRef || t == typeOfDocRef
 }
 
 type tagOptions struct {
-	omitEmpty       bool   // do not marshal value if empty
-	serverTimestamp bool   // set time.Time to server timestamp on write
-	reference       string // collection referenced by this field
+	omitEmpty             bool       // do not marshal value if empty
+	serverTimestamp       bool       // set zero time.Time to server timestamp on write
+	serverTimestampAlways bool       // set time.Time to server timestamp on every write
+	reference             string     // collection referenced by this field
+	refAs                 refStorage // how the reference is stored, set by the "as=" tag option
+	remain                bool       // holds document fields that match no other field
+	computed              bool       // set by a method on write and read
+	readonly              bool       // read but never written
+	writeonly             bool       // written but never read
+
+	onMissing    MissingPolicy // policy for missing referenced documents, if hasOnMissing
+	hasOnMissing bool          // set by the "onmissing=" tag option
+
+	aliases     []string // former names of this field, accepted on read
+	constraints constraints
 }
 
+// A refStorage is the form in which a reference field stores the IDs of the
+// documents it refers to, set by the "as=" tag option. Whatever the form,
+// reference fields can be read from any of them.
+type refStorage int
+
+const (
+	refByID        refStorage = iota // as=id, the default: the bare document ID
+	refByPath                        // as=path: the document's path, such as "users/1"
+	refByReference                   // as=reference: a Firestore reference to the document
+)
+
 // parseTag interprets firestore struct field tags.
 func parseTag(t reflect.StructTag) (name string, keep bool, options *tagOptions, err error) {
 	name, keep, opts, err := parseStandardTag("calcifer", t)
 	if err != nil {
-		return "", false, nil, fmt.Errorf("calcifer: %v", err)
+		return "", false, nil, err
 	}
 	tagOpts := tagOptions{}
 	for _, opt := range opts {
 		if strings.HasPrefix(opt, "ref:") {
 			tagOpts.reference = strings.TrimPrefix(opt, "ref:")
+			if tagOpts.reference == "" {
+				return "", false, nil, errors.New("empty ref tag option")
+			}
+			continue
+		}
+		if strings.HasPrefix(opt, "as=") {
+			switch strings.TrimPrefix(opt, "as=") {
+			case "id":
+				tagOpts.refAs = refByID
+			case "path":
+				tagOpts.refAs = refByPath
+			case "reference":
+				tagOpts.refAs = refByReference
+			default:
+				return "", false, nil, fmt.Errorf("unknown tag option %q", opt)
+			}
+			continue
+		}
+		if strings.HasPrefix(opt, "onmissing=") {
+			p, ok := missingPolicies[strings.TrimPrefix(opt, "onmissing=")]
+			if !ok {
+				return "", false, nil, fmt.Errorf("unknown tag option %q", opt)
+			}
+			tagOpts.onMissing, tagOpts.hasOnMissing = p, true
+			continue
+		}
+		if strings.HasPrefix(opt, "alias:") {
+			alias := strings.TrimPrefix(opt, "alias:")
+			if alias == "" {
+				return "", false, nil, errors.New("empty alias tag option")
+			}
+			tagOpts.aliases = append(tagOpts.aliases, alias)
 			continue
 		}
 		switch opt {
@@ -276,8 +396,25 @@ func parseTag(t reflect.StructTag) (name string, keep bool, options *tagOptions,
 			tagOpts.omitEmpty = true
 		case "serverTimestamp":
 			tagOpts.serverTimestamp = true
+		case "serverTimestamp:always":
+			tagOpts.serverTimestamp = true
+			tagOpts.serverTimestampAlways = true
+		case "remain":
+			tagOpts.remain = true
+		case "computed":
+			tagOpts.computed = true
+		case "readonly":
+			tagOpts.readonly = true
+		case "writeonly":
+			tagOpts.writeonly = true
 		default:
-			return "", false, nil, fmt.Errorf("firestore: unknown tag option: %q", opt)
+			if ok, err := tagOpts.constraints.parse(opt); ok {
+				if err != nil {
+					return "", false, nil, err
+				}
+				continue
+			}
+			return "", false, nil, fmt.Errorf("unknown tag option %q", opt)
 		}
 	}
 	return name, keep, &tagOpts, nil
@@ -285,10 +422,12 @@ func parseTag(t reflect.StructTag) (name string, keep bool, options *tagOptions,
 
 // parseStandardTag extracts the sub-tag named by key, then parses it using the
 // de facto standard format introduced in encoding/json:
-//   "-" means "ignore this tag". It must occur by itself. (parseStandardTag returns an error
-//       in this case, whereas encoding/json accepts the "-" even if it is not alone.)
-//   "<name>" provides an alternative name for the field
-//   "<name>,opt1,opt2,..." specifies options after the name.
+//
+//	"-" means "ignore this tag". It must occur by itself. (parseStandardTag returns an error
+//	    in this case, whereas encoding/json accepts the "-" even if it is not alone.)
+//	"<name>" provides an alternative name for the field
+//	"<name>,opt1,opt2,..." specifies options after the name.
+//
 // The options are returned as a []string.
 func parseStandardTag(key string, t reflect.StructTag) (name string, keep bool, options []string, err error) {
 	s := t.Get(key)
@@ -15,10 +15,13 @@
 package calcifer
 
 import (
+	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/type/latlng"
 )
 
 func TestRegisterModel(t *testing.T) {
@@ -37,3 +40,109 @@ func TestFields(t *testing.T) {
 	_, err = defaultFieldCache.fields(reflect.TypeOf(&e))
 	assert.NoError(t, err)
 }
+
+func TestRemainFieldValidation(t *testing.T) {
+	type wrongType struct {
+		Extra map[string]string `calcifer:",remain"`
+	}
+	_, err := defaultFieldCache.fields(reflect.TypeOf(wrongType{}))
+	assert.ErrorContains(t, err, "map[string]interface{}")
+
+	type twoRemains struct {
+		A map[string]interface{} `calcifer:",remain"`
+		B map[string]interface{} `calcifer:",remain"`
+	}
+	_, err = defaultFieldCache.fields(reflect.TypeOf(twoRemains{}))
+	assert.ErrorContains(t, err, "multiple remain fields")
+}
+
+func TestAliasValidation(t *testing.T) {
+	type clash struct {
+		Name     string `calcifer:"name,alias:fullName"`
+		FullName string `calcifer:"fullName"`
+	}
+	_, err := defaultFieldCache.fields(reflect.TypeOf(clash{}))
+	assert.ErrorContains(t, err, `alias "fullName"`)
+
+	type empty struct {
+		Name string `calcifer:"name,alias:"`
+	}
+	_, err = defaultFieldCache.fields(reflect.TypeOf(empty{}))
+	assert.ErrorContains(t, err, "empty alias")
+}
+
+func TestRegisterModelValidation(t *testing.T) {
+	type notAModel struct {
+		X int `calcifer:"x"`
+	}
+	type related struct {
+		Model
+		Bad chan int `calcifer:"bad"`
+	}
+	type address struct {
+		Street string        `calcifer:"street,bogus"`
+		Geo    latlng.LatLng `calcifer:"geo"`
+	}
+	type stamped struct {
+		At time.Time `calcifer:"at,serverTimestamp"`
+	}
+	type badModel struct {
+		Model
+		Name     string                   `calcifer:"name"`
+		Title    string                   `calcifer:"name"`
+		Created  string                   `calcifer:"created,serverTimestamp"`
+		Address  address                  `calcifer:"address"`
+		Scores   map[int]float64          `calcifer:"scores"`
+		Handler  func()                   `calcifer:"handler"`
+		Stringer fmt.Stringer             `calcifer:"stringer"`
+		Owner    related                  `calcifer:"owner,ref:users"`
+		Others   []*notAModel             `calcifer:"others,ref:others"`
+		Friend   *related                 `calcifer:"friend,ref:users"`
+		Count    int                      `calcifer:"count,ref:"`
+		Extra    map[string]interface{}   `calcifer:",remain"`
+		More     map[string]string        `calcifer:",remain"`
+		Nested   []map[string]*notAModel  `calcifer:"nested"`
+		Fine     map[string][]interface{} `calcifer:"fine"`
+		Policy   string                   `calcifer:"policy,onmissing=nil"`
+		Lost     string                   `calcifer:"lost,onmissing=ignore"`
+		ByRank   map[int]*User            `calcifer:"by_rank,ref:users"`
+		Groups   map[string]notAModel     `calcifer:"groups,ref:groups"`
+		ByRole   map[string]*User         `calcifer:"by_role,ref:users,onmissing=drop"`
+		Stamps   []stamped                `calcifer:"stamps"`
+		ByDay    map[string]stamped       `calcifer:"by_day"`
+	}
+	err := RegisterModel(badModel{})
+	var mte *ModelTypeError
+	if !assert.ErrorAs(t, err, &mte) {
+		return
+	}
+	assert.Equal(t, reflect.TypeOf(badModel{}), mte.Type)
+	problems := map[string]string{}
+	for _, p := range mte.Problems {
+		problems[p.Path] += p.Error()
+	}
+	assert.Contains(t, problems["Address.Street"], "unknown tag option")
+	assert.Contains(t, problems["Address.Geo"], "must be used by pointer")
+	assert.Contains(t, problems["Title"], "duplicate field name")
+	assert.Contains(t, problems["Created"], "time.Time")
+	assert.Contains(t, problems["Scores"], "map key type int")
+	assert.Contains(t, problems["Handler"], "unsupported type func()")
+	assert.Contains(t, problems["Stringer"], "unsupported interface type")
+	assert.Contains(t, problems["Owner"], "must be a pointer")
+	assert.Contains(t, problems["Others"], "does not embed calcifer.Model")
+	assert.Contains(t, problems["Friend.Bad"], "unsupported type chan int")
+	assert.Contains(t, problems["Count"], "empty ref tag option")
+	assert.Contains(t, problems["More"], "multiple remain fields")
+	assert.Contains(t, problems["Policy"], "onmissing tag option requires a ref tag option")
+	assert.Contains(t, problems["Lost"], `unknown tag option "onmissing=ignore"`)
+	assert.Contains(t, problems["ByRank"], "map key type int")
+	assert.Contains(t, problems["Groups"], "does not embed calcifer.Model")
+	assert.NotContains(t, problems, "ByRole")
+	assert.Contains(t, problems["Stamps.At"], "serverTimestamp field cannot be in a slice")
+	assert.NotContains(t, problems, "ByDay.At")
+	assert.NotContains(t, problems, "Name")
+	assert.NotContains(t, problems, "Nested")
+	assert.NotContains(t, problems, "Fine")
+	assert.Len(t, mte.Problems, 18)
+	assert.Contains(t, err.Error(), "\n\tAddress.Street: ")
+}
@@ -0,0 +1,141 @@
+// Copyright 2022 Radiopaper Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calcifer
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+)
+
+// ValueMarshaler is the interface implemented by types that can convert themselves
+// into a value that calcifer can store in Firestore, such as a string, a number or a
+// map[string]interface{}. The returned value is itself converted as a field value.
+type ValueMarshaler interface {
+	MarshalFirestore() (interface{}, error)
+}
+
+// ValueUnmarshaler is the interface implemented by types that can set themselves
+// from a value read from Firestore. The value is as returned by
+// firestore.DocumentSnapshot.Data, e.g. an int64, a string or a map[string]interface{}.
+type ValueUnmarshaler interface {
+	UnmarshalFirestore(interface{}) error
+}
+
+// Types that implement neither ValueMarshaler nor ValueUnmarshaler but implement
+// encoding.TextMarshaler or encoding.TextUnmarshaler are stored as strings.
+
+var (
+	typeOfValueMarshaler   = reflect.TypeOf((*ValueMarshaler)(nil)).Elem()
+	typeOfValueUnmarshaler = reflect.TypeOf((*ValueUnmarshaler)(nil)).Elem()
+	typeOfTextMarshaler    = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	typeOfTextUnmarshaler  = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// hasMarshalOrUnmarshalMethod reports whether values of type t, or pointers to
+// them, control their own Firestore representation: whether they implement any
+// of ValueMarshaler, ValueUnmarshaler, encoding.TextMarshaler and
+// encoding.TextUnmarshaler.
+func hasMarshalOrUnmarshalMethod(t reflect.Type) bool {
+	pt := reflect.PointerTo(t)
+	for _, it := range []reflect.Type{typeOfValueMarshaler, typeOfValueUnmarshaler, typeOfTextMarshaler, typeOfTextUnmarshaler} {
+		if t.Implements(it) || pt.Implements(it) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasMarshalMethod reports whether values of type t, or pointers to them,
+// implement ValueMarshaler or encoding.TextMarshaler, and so are written by
+// their own methods.
+func hasMarshalMethod(t reflect.Type) bool {
+	pt := reflect.PointerTo(t)
+	return t.Implements(typeOfValueMarshaler) || t.Implements(typeOfTextMarshaler) ||
+		pt.Implements(typeOfValueMarshaler) || pt.Implements(typeOfTextMarshaler)
+}
+
+// marshalValue converts v to a Firestore value using its MarshalFirestore or
+// MarshalText method, if it has one. It reports whether v had such a method.
+// Pointers are not marshaled themselves; the values they point to are.
+func marshalValue(enc *encoder, v reflect.Value) (interface{}, bool, error) {
+	t := v.Type()
+	if t.Kind() == reflect.Pointer || t.Kind() == reflect.Interface {
+		return nil, false, nil
+	}
+	pt := reflect.PointerTo(t)
+	if !t.Implements(typeOfValueMarshaler) && !t.Implements(typeOfTextMarshaler) &&
+		(pt.Implements(typeOfValueMarshaler) || pt.Implements(typeOfTextMarshaler)) {
+		// Use the pointer method set, copying v if it isn't addressable.
+		if !v.CanAddr() {
+			c := reflect.New(t).Elem()
+			c.Set(v)
+			v = c
+		}
+		v = v.Addr()
+	}
+	switch x := v.Interface().(type) {
+	case ValueMarshaler:
+		mv, err := x.MarshalFirestore()
+		if err != nil {
+			return nil, true, fmt.Errorf("calcifer: MarshalFirestore of type %s: %w", t, err)
+		}
+		if mv == nil {
+			return nil, true, nil
+		}
+		iv, err := enc.valueToInterface(reflect.ValueOf(mv))
+		return iv, true, err
+	case encoding.TextMarshaler:
+		b, err := x.MarshalText()
+		if err != nil {
+			return nil, true, fmt.Errorf("calcifer: MarshalText of type %s: %w", t, err)
+		}
+		return string(b), true, nil
+	}
+	return nil, false, nil
+}
+
+// isUnmarshalingType reports whether pointers to values of type t implement
+// ValueUnmarshaler or encoding.TextUnmarshaler.
+func isUnmarshalingType(t reflect.Type) bool {
+	pt := reflect.PointerTo(t)
+	return pt.Implements(typeOfValueUnmarshaler) || pt.Implements(typeOfTextUnmarshaler)
+}
+
+// unmarshalValue sets v from the Firestore value d using the UnmarshalFirestore or
+// UnmarshalText method of v's address, if it has one. It reports whether v had
+// such a method. UnmarshalText is only used if d is a string.
+func unmarshalValue(v reflect.Value, d interface{}) (bool, error) {
+	if !v.CanAddr() {
+		return false, nil
+	}
+	switch x := v.Addr().Interface().(type) {
+	case ValueUnmarshaler:
+		if err := x.UnmarshalFirestore(d); err != nil {
+			return true, fmt.Errorf("calcifer: UnmarshalFirestore of type %s: %w", v.Type(), err)
+		}
+		return true, nil
+	case encoding.TextUnmarshaler:
+		s, ok := d.(string)
+		if !ok {
+			return false, nil
+		}
+		if err := x.UnmarshalText([]byte(s)); err != nil {
+			return true, fmt.Errorf("calcifer: UnmarshalText of type %s: %w", v.Type(), err)
+		}
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2022 Radiopaper Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calcifer
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type money struct {
+	cents    int64
+	currency string
+}
+
+func (m money) MarshalFirestore() (interface{}, error) {
+	if m.currency == "" {
+		return nil, errors.New("missing currency")
+	}
+	return map[string]interface{}{"amount": m.cents, "currency": m.currency}, nil
+}
+
+func (m *money) UnmarshalFirestore(d interface{}) error {
+	x, ok := d.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("cannot unmarshal %T into money", d)
+	}
+	m.cents, _ = x["amount"].(int64)
+	m.currency, _ = x["currency"].(string)
+	return nil
+}
+
+type color int
+
+const (
+	red color = iota
+	green
+)
+
+var colorNames = []string{"red", "green"}
+
+func (c *color) MarshalText() ([]byte, error) {
+	return []byte(colorNames[*c]), nil
+}
+
+func (c *color) UnmarshalText(b []byte) error {
+	for i, n := range colorNames {
+		if n == string(b) {
+			*c = color(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown color %q", b)
+}
+
+type marshalerModel struct {
+	Model
+	Price   money            `calcifer:"price"`
+	Tip     *money           `calcifer:"tip"`
+	Color   color            `calcifer:"color"`
+	Palette []color          `calcifer:"palette"`
+	Addr    netip.Addr       `calcifer:"addr"`
+	Hosts   map[string]money `calcifer:"hosts"`
+}
+
+func TestValueToInterfaceMarshalers(t *testing.T) {
+	m := marshalerModel{
+		Model:   Model{ID: "1"},
+		Price:   money{250, "USD"},
+		Color:   green,
+		Palette: []color{red, green},
+		Addr:    netip.MustParseAddr("10.0.0.1"),
+		Hosts:   map[string]money{"dave": {100, "EUR"}},
+	}
+	i, err := modelToDoc(m)
+	assert.NoError(t, err)
+	im := i.(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"amount": int64(250), "currency": "USD"}, im["price"])
+	assert.Nil(t, im["tip"])
+	assert.Equal(t, "green", im["color"])
+	assert.Equal(t, []interface{}{"red", "green"}, im["palette"])
+	assert.Equal(t, "10.0.0.1", im["addr"])
+	assert.Equal(t, map[string]interface{}{"dave": map[string]interface{}{"amount": int64(100), "currency": "EUR"}}, im["hosts"])
+
+	_, err = valueToInterface(reflect.ValueOf(money{}))
+	assert.ErrorContains(t, err, "missing currency")
+}
+
+func TestDataToValueUnmarshalers(t *testing.T) {
+	d := map[string]interface{}{
+		"price":   map[string]interface{}{"amount": int64(250), "currency": "USD"},
+		"tip":     map[string]interface{}{"amount": int64(50), "currency": "USD"},
+		"color":   "green",
+		"palette": []interface{}{"red", "green"},
+		"addr":    "10.0.0.1",
+		"hosts":   map[string]interface{}{"dave": map[string]interface{}{"amount": int64(100), "currency": "EUR"}},
+	}
+	var m marshalerModel
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&m), d))
+	assert.Equal(t, money{250, "USD"}, m.Price)
+	assert.Equal(t, &money{50, "USD"}, m.Tip)
+	assert.Equal(t, green, m.Color)
+	assert.Equal(t, []color{red, green}, m.Palette)
+	assert.Equal(t, netip.MustParseAddr("10.0.0.1"), m.Addr)
+	assert.Equal(t, map[string]money{"dave": {100, "EUR"}}, m.Hosts)
+
+	var c color
+	assert.ErrorContains(t, (&decoder{}).dataToValue(reflect.ValueOf(&c).Elem(), "blue"), "unknown color")
+	var p money
+	assert.Error(t, (&decoder{}).dataToValue(reflect.ValueOf(&p).Elem(), "ten dollars"))
+}
@@ -0,0 +1,192 @@
+// Copyright 2022 Radiopaper Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calcifer
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// schemaVersionField is the name of the document field that holds Model.SchemaVersion.
+const schemaVersionField = "schema_version"
+
+// A migration upgrades the data of a document to schema version to.
+type migration struct {
+	to int
+	f  func(map[string]interface{}) error
+}
+
+// A schema holds the migrations registered for a model type.
+type schema struct {
+	current int               // highest version reached by a migration
+	steps   map[int]migration // by the version they upgrade from
+}
+
+var schemas struct {
+	sync.RWMutex
+	m map[reflect.Type]*schema
+}
+
+// MustRegisterMigration is like RegisterMigration but panics if the migration
+// cannot be registered.
+func MustRegisterMigration[T ReadableModel](from, to int, f func(map[string]any) error) {
+	if err := RegisterMigration[T](from, to, f); err != nil {
+		panic(err)
+	}
+}
+
+// RegisterMigration registers f to upgrade the documents of model type T from
+// schema version from to schema version to. The current schema version of T is
+// the highest version that its migrations reach, or 0 if it has none.
+//
+// When a document of T is read, its schema version is that in its
+// "schema_version" field, or 0 if it has none. The migrations of T are applied
+// in turn to the document's data until it reaches the current version, and the
+// model is then populated from the upgraded data, its SchemaVersion being set
+// to the current version. Documents written from models of T are given the
+// current version. With the WriteBackMigrations policy, documents that were
+// upgraded on read are also stored in their upgraded form.
+//
+// Migrations should be registered at startup, before documents of T are read.
+func RegisterMigration[T ReadableModel](from, to int, f func(map[string]any) error) error {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if from < 0 || to <= from {
+		return fmt.Errorf("calcifer: invalid migration of %s from schema version %d to %d", t, from, to)
+	}
+	if f == nil {
+		return fmt.Errorf("calcifer: nil migration of %s from schema version %d", t, from)
+	}
+	schemas.Lock()
+	defer schemas.Unlock()
+	if schemas.m == nil {
+		schemas.m = make(map[reflect.Type]*schema)
+	}
+	s := schemas.m[t]
+	if s == nil {
+		s = &schema{steps: make(map[int]migration)}
+		schemas.m[t] = s
+	}
+	if _, ok := s.steps[from]; ok {
+		return fmt.Errorf("calcifer: migration of %s from schema version %d already registered", t, from)
+	}
+	s.steps[from] = migration{to: to, f: f}
+	if to > s.current {
+		s.current = to
+	}
+	return nil
+}
+
+// schemaVersion returns the current schema version of model type t.
+func schemaVersion(t reflect.Type) int {
+	schemas.RLock()
+	defer schemas.RUnlock()
+	if s := schemas.m[t]; s != nil {
+		return s.current
+	}
+	return 0
+}
+
+// migrate upgrades d, the data of a document of model type t, to the current
+// schema version of t, reporting whether any migration was applied.
+func migrate(t reflect.Type, d map[string]interface{}) (bool, error) {
+	schemas.RLock()
+	defer schemas.RUnlock()
+	s := schemas.m[t]
+	if s == nil || d == nil {
+		return false, nil
+	}
+	var version int
+	switch x := d[schemaVersionField].(type) {
+	case nil:
+	case int64:
+		version = int(x)
+	default:
+		return false, fmt.Errorf("calcifer: schema version of %s is %T, not an integer", t, x)
+	}
+	if version >= s.current {
+		return false, nil
+	}
+	for version < s.current {
+		m, ok := s.steps[version]
+		if !ok {
+			return false, fmt.Errorf("calcifer: no migration of %s from schema version %d", t, version)
+		}
+		if err := m.f(d); err != nil {
+			return false, fmt.Errorf("calcifer: migrating %s from schema version %d: %w", t, version, err)
+		}
+		version = m.to
+	}
+	d[schemaVersionField] = int64(version)
+	return true, nil
+}
+
+// A MigrationPolicy is a ClientOption that determines what happens to documents
+// that are upgraded by migrations when they are read; see RegisterMigration.
+type MigrationPolicy int
+
+const (
+	// MigrateOnRead leaves upgraded documents as they are stored, so they are
+	// upgraded again on every read. It is the default.
+	MigrateOnRead MigrationPolicy = iota
+	// WriteBackMigrations makes reads outside of transactions store upgraded
+	// documents, unless they have changed since they were read. Only the
+	// documents read by Get or a DocumentIterator are stored; those read by
+	// expanding their reference fields are upgraded on every read.
+	WriteBackMigrations
+)
+
+func (p MigrationPolicy) applyClient(c *Client) { c.migrations = p }
+
+// readModel is docToModel for the documents read by Get and DocumentIterators
+// outside of transactions, which also writes back upgraded documents under the
+// WriteBackMigrations policy.
+func (c *Client) readModel(ctx context.Context, m MutableModel, doc *firestore.DocumentSnapshot) error {
+	d, err := c.decodeDoc(m, doc)
+	if err != nil || d == nil || c.migrations != WriteBackMigrations {
+		return err
+	}
+	// Fields that the migrations removed are deleted.
+	var updates []firestore.Update
+	for k := range doc.Data() {
+		if _, ok := d[k]; !ok {
+			updates = append(updates, firestore.Update{FieldPath: []string{k}, Value: firestore.Delete})
+		}
+	}
+	for k, v := range d {
+		updates = append(updates, firestore.Update{FieldPath: []string{k}, Value: v})
+	}
+	sort.Slice(updates, func(i, j int) bool { return updates[i].FieldPath[0] < updates[j].FieldPath[0] })
+	wr, err := doc.Ref.Update(ctx, updates, firestore.LastUpdateTime(doc.UpdateTime))
+	if status.Code(err) == codes.FailedPrecondition {
+		// The document changed since it was read; whoever changed it may
+		// have upgraded it, and otherwise the next read will.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	m.setUpdateTime(wr.UpdateTime)
+	return nil
+}
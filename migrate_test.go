@@ -0,0 +1,172 @@
+// Copyright 2022 Radiopaper Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calcifer
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A venue was first stored with a single "name" field, which version 1 split
+// into first and last names and version 2 renamed to "title" and "subtitle".
+type venue struct {
+	Model
+	Title    string `calcifer:"title"`
+	Subtitle string `calcifer:"subtitle"`
+}
+
+func init() {
+	MustRegisterMigration[venue](0, 1, func(d map[string]any) error {
+		name, _ := d["name"].(string)
+		first, last, _ := strings.Cut(name, " ")
+		d["first"], d["last"] = first, last
+		delete(d, "name")
+		return nil
+	})
+	MustRegisterMigration[*venue](1, 2, func(d map[string]any) error {
+		if d["first"] == "" {
+			return errors.New("no name")
+		}
+		d["title"], d["subtitle"] = d["first"], d["last"]
+		delete(d, "first")
+		delete(d, "last")
+		return nil
+	})
+}
+
+func TestMigrate(t *testing.T) {
+	vt := reflect.TypeOf(venue{})
+	assert.Equal(t, 2, schemaVersion(vt))
+
+	d := map[string]interface{}{"name": "Royal Albert"}
+	migrated, err := migrate(vt, d)
+	assert.NoError(t, err)
+	assert.True(t, migrated)
+	assert.Equal(t, map[string]interface{}{"title": "Royal", "subtitle": "Albert", "schema_version": int64(2)}, d)
+
+	var v venue
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&v), d))
+	assert.Equal(t, venue{Model: Model{SchemaVersion: 2}, Title: "Royal", Subtitle: "Albert"}, v)
+
+	d = map[string]interface{}{"first": "Royal", "last": "Albert", "schema_version": int64(1)}
+	migrated, err = migrate(vt, d)
+	assert.NoError(t, err)
+	assert.True(t, migrated)
+	assert.Equal(t, "Royal", d["title"])
+
+	d = map[string]interface{}{"title": "Royal", "schema_version": int64(2)}
+	migrated, err = migrate(vt, d)
+	assert.NoError(t, err)
+	assert.False(t, migrated)
+
+	_, err = migrate(vt, map[string]interface{}{"name": ""})
+	assert.ErrorContains(t, err, "no name")
+	_, err = migrate(vt, map[string]interface{}{"schema_version": "1"})
+	assert.Error(t, err)
+
+	migrated, err = migrate(reflect.TypeOf(User{}), map[string]interface{}{"Email": "dave@example.com"})
+	assert.NoError(t, err)
+	assert.False(t, migrated)
+}
+
+func TestRegisterMigration(t *testing.T) {
+	type gig struct{ Model }
+	assert.NoError(t, RegisterMigration[gig](0, 2, func(map[string]any) error { return nil }))
+	assert.Error(t, RegisterMigration[gig](0, 1, func(map[string]any) error { return nil }))
+	assert.Error(t, RegisterMigration[gig](2, 2, func(map[string]any) error { return nil }))
+	assert.Error(t, RegisterMigration[gig](2, 3, nil))
+
+	// Migrations must reach the current version.
+	assert.NoError(t, RegisterMigration[gig](3, 4, func(map[string]any) error { return nil }))
+	_, err := migrate(reflect.TypeOf(gig{}), map[string]interface{}{})
+	assert.ErrorContains(t, err, "no migration")
+}
+
+func TestMigrateWhileRegistering(t *testing.T) {
+	type tour struct {
+		Model
+	}
+	tt := reflect.TypeOf(tour{})
+	nop := func(map[string]any) error { return nil }
+	assert.NoError(t, RegisterMigration[tour](0, 1, nop))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for v := 1; v < 50; v++ {
+			assert.NoError(t, RegisterMigration[tour](v, v+1, nop))
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		_, err := migrate(tt, map[string]interface{}{})
+		assert.NoError(t, err)
+	}
+	<-done
+}
+
+func TestModelToDocSchemaVersion(t *testing.T) {
+	i, err := modelToDoc(&venue{Title: "Royal"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), i.(map[string]interface{})["schema_version"])
+
+	i, err = modelToDoc(&User{})
+	assert.NoError(t, err)
+	assert.NotContains(t, i.(map[string]interface{}), "schema_version")
+}
+
+func TestMigrationWriteBack(t *testing.T) {
+	ctx := context.Background()
+	cli := testClient(t)
+	wcli := NewClient(cli.fs, WriteBackMigrations)
+
+	_, err := cli.fs.Collection("venues").Doc("1").Set(ctx, map[string]interface{}{"name": "Royal Albert"})
+	assert.NoError(t, err)
+
+	var v venue
+	assert.NoError(t, cli.Collection("venues").Doc("1").Get(ctx, &v))
+	assert.Equal(t, "Royal", v.Title)
+	assert.Equal(t, 2, v.SchemaVersion)
+	doc, err := cli.fs.Collection("venues").Doc("1").Get(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "Royal Albert"}, doc.Data())
+
+	var w venue
+	assert.NoError(t, wcli.Collection("venues").Doc("1").Get(ctx, &w))
+	assert.Equal(t, "Royal", w.Title)
+	doc, err = cli.fs.Collection("venues").Doc("1").Get(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"title": "Royal", "subtitle": "Albert", "schema_version": int64(2)}, doc.Data())
+	assert.Equal(t, doc.UpdateTime, w.UpdateTime)
+
+	// Documents read by expansion are upgraded, but not written back.
+	type booking struct {
+		Model
+		Venue *venue `calcifer:"venue,ref:venues"`
+	}
+	_, err = cli.fs.Collection("venues").Doc("2").Set(ctx, map[string]interface{}{"name": "Albert Hall"})
+	assert.NoError(t, err)
+	_, err = cli.fs.Collection("bookings").Doc("1").Set(ctx, map[string]interface{}{"venue": "2"})
+	assert.NoError(t, err)
+	var b booking
+	assert.NoError(t, wcli.Collection("bookings").Doc("1").Get(ctx, &b))
+	assert.Equal(t, "Albert", b.Venue.Title)
+	doc, err = cli.fs.Collection("venues").Doc("2").Get(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "Albert Hall"}, doc.Data())
+}
@@ -18,23 +18,35 @@ import "time"
 
 // A Model is a Go-native representation of a document that can be stored in Firestore.
 // Embeded `Model` into your own struct to define other types of models.
+//
+// See the package documentation for the struct tags that map the fields of
+// models to document fields.
 type Model struct {
 	ID         string    `calcifer:"id" json:"id"`
 	CreateTime time.Time `calcifer:"create_time" json:"create_time"`
 	UpdateTime time.Time `calcifer:"update_time" json:"update_time"`
+
+	// SchemaVersion is the schema version of the document; see RegisterMigration.
+	SchemaVersion int `calcifer:"schema_version,omitempty" json:"schema_version,omitempty"`
 }
 
 // The ReadbleModel interface is satisfied only by calcifer.Model and structs that embed it.
 type ReadableModel interface {
 	isModel() bool
+	updateTime() time.Time
 }
 
 func (m Model) isModel() bool {
 	return true
 }
 
+func (m Model) updateTime() time.Time {
+	return m.UpdateTime
+}
+
 // The MutableModel interface is satisfied only by pointers to calcifer.Model and structs that embed it.
 type MutableModel interface {
+	ReadableModel
 	setID(string)
 	setCreateTime(time.Time)
 	setUpdateTime(time.Time)
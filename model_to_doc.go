@@ -17,11 +17,23 @@ package calcifer
 import (
 	"errors"
 	"fmt"
+	"math"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"cloud.google.com/go/firestore"
 )
 
+// modelToDoc converts m to a Firestore document without a client, so it cannot
+// encode references stored as Firestore references.
 func modelToDoc(m ReadableModel) (interface{}, error) {
+	return (&encoder{}).modelToDoc(m)
+}
+
+func (enc *encoder) modelToDoc(m ReadableModel) (interface{}, error) {
 	v := reflect.ValueOf(m)
 	if v.Kind() == reflect.Pointer {
 		if v.IsNil() {
@@ -33,115 +45,527 @@ func modelToDoc(m ReadableModel) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
-	return structToInterface(v)
+	doc, err := enc.valueToInterface(v)
+	if err != nil {
+		return nil, err
+	}
+	if version := schemaVersion(v.Type()); version > 0 {
+		doc.(map[string]interface{})[schemaVersionField] = int64(version)
+	}
+	return doc, nil
+}
+
+// An encoder converts Go values to Firestore data.
+type encoder struct {
+	cli *Client // client of the references stored as Firestore references; may be nil
 }
 
+// An encoderFunc converts a value of a particular type to its Firestore representation.
+type encoderFunc func(enc *encoder, v reflect.Value) (interface{}, error)
+
+var encoderCache sync.Map // from reflect.Type to encoderFunc
+
+// valueToInterface is encoder.valueToInterface without a client.
 func valueToInterface(v reflect.Value) (interface{}, error) {
-	vi := v.Interface()
-	switch x := vi.(type) {
-	case []byte:
-		return x, nil
-	case time.Time:
-		return x, nil
+	return (&encoder{}).valueToInterface(v)
+}
+
+// valueToInterface converts v to its Firestore representation, returning an
+// *EncodeError on failure.
+func (enc *encoder) valueToInterface(v reflect.Value) (interface{}, error) {
+	i, err := typeEncoder(v.Type())(enc, v)
+	if err != nil {
+		return nil, encodeErr(v.Type(), err)
 	}
-	switch v.Kind() {
+	return i, nil
+}
+
+// typeEncoder returns the cached encoderFunc for values of type t, building it
+// on first use.
+func typeEncoder(t reflect.Type) encoderFunc {
+	if fi, ok := encoderCache.Load(t); ok {
+		return fi.(encoderFunc)
+	}
+
+	// To deal with recursive types, populate the cache with an indirect func
+	// before building the encoder. This type waits on the real func (f) to be
+	// ready and then calls it. The indirect func is only used for recursive types.
+	var (
+		wg sync.WaitGroup
+		f  encoderFunc
+	)
+	wg.Add(1)
+	fi, loaded := encoderCache.LoadOrStore(t, encoderFunc(func(enc *encoder, v reflect.Value) (interface{}, error) {
+		wg.Wait()
+		return f(enc, v)
+	}))
+	if loaded {
+		return fi.(encoderFunc)
+	}
+	f = newTypeEncoder(t)
+	wg.Done()
+	encoderCache.Store(t, f)
+	return f
+}
+
+func newTypeEncoder(t reflect.Type) encoderFunc {
+	switch t {
+	case typeOfByteSlice, typeOfGoTime:
+		return interfaceEncoder
+	case typeOfLatLng, typeOfProtoTimestamp, typeOfFirestoreDocRef:
+		return nilOrInterfaceEncoder
+	case typeOfDocRef:
+		return docRefEncoder
+	}
+	if t.Kind() != reflect.Pointer && t.Kind() != reflect.Interface && hasMarshalMethod(t) {
+		return marshalerEncoder
+	}
+	switch t.Kind() {
 	case reflect.Bool:
-		return v.Bool(), nil
+		return boolEncoder
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		return v.Int(), nil
+		return intEncoder
 	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
-		return uint32(v.Uint()), nil
+		return uint32Encoder
+	case reflect.Uint, reflect.Uint64:
+		return uintEncoder
 	case reflect.Float32, reflect.Float64:
-		return v.Float(), nil
+		return floatEncoder
 	case reflect.String:
-		return v.String(), nil
+		return stringEncoder
 	case reflect.Slice:
-		return sliceToInterface(v)
+		return newSliceEncoder(t)
 	case reflect.Map:
-		return mapToInterface(v)
+		return newMapEncoder(t)
 	case reflect.Struct:
-		return structToInterface(v)
+		if isLeafType(t) {
+			return errorEncoder(fmt.Errorf("calcifer: type %s must be used by pointer", t))
+		}
+		return newStructEncoder(t)
 	case reflect.Ptr:
+		return newPtrEncoder(t)
+	case reflect.Interface:
+		if t.NumMethod() == 0 { // empty interface: encode its contents
+			return emptyInterfaceEncoder
+		}
+	}
+	return errorEncoder(fmt.Errorf("calcifer: cannot convert type %s to firestore value", t))
+}
+
+func errorEncoder(err error) encoderFunc {
+	return func(*encoder, reflect.Value) (interface{}, error) { return nil, err }
+}
+
+func interfaceEncoder(_ *encoder, v reflect.Value) (interface{}, error) {
+	return v.Interface(), nil
+}
+
+func nilOrInterfaceEncoder(_ *encoder, v reflect.Value) (interface{}, error) {
+	if v.IsNil() {
+		return nil, nil
+	}
+	return v.Interface(), nil
+}
+
+func docRefEncoder(_ *encoder, v reflect.Value) (interface{}, error) {
+	x := v.Interface().(*DocumentRef)
+	if x == nil || x.DocumentRef == nil {
+		return nil, nil
+	}
+	return x.DocumentRef, nil
+}
+
+func marshalerEncoder(enc *encoder, v reflect.Value) (interface{}, error) {
+	mv, _, err := marshalValue(enc, v)
+	return mv, err
+}
+
+func boolEncoder(_ *encoder, v reflect.Value) (interface{}, error) {
+	return v.Bool(), nil
+}
+
+func intEncoder(_ *encoder, v reflect.Value) (interface{}, error) {
+	return v.Int(), nil
+}
+
+func uint32Encoder(_ *encoder, v reflect.Value) (interface{}, error) {
+	return uint32(v.Uint()), nil
+}
+
+func uintEncoder(_ *encoder, v reflect.Value) (interface{}, error) {
+	// Firestore stores integers as int64.
+	u := v.Uint()
+	if u > math.MaxInt64 {
+		return nil, fmt.Errorf("calcifer: value %v of type %s overflows int64", u, v.Type())
+	}
+	return int64(u), nil
+}
+
+func floatEncoder(_ *encoder, v reflect.Value) (interface{}, error) {
+	return v.Float(), nil
+}
+
+func stringEncoder(_ *encoder, v reflect.Value) (interface{}, error) {
+	return v.String(), nil
+}
+
+func emptyInterfaceEncoder(enc *encoder, v reflect.Value) (interface{}, error) {
+	if v.IsNil() {
+		return nil, nil
+	}
+	return enc.valueToInterface(v.Elem())
+}
+
+func newPtrEncoder(t reflect.Type) encoderFunc {
+	elemEnc := typeEncoder(t.Elem())
+	return func(enc *encoder, v reflect.Value) (interface{}, error) {
 		if v.IsNil() {
 			return nil, nil
 		}
-		return valueToInterface(v.Elem())
-	case reflect.Interface:
-		if v.NumMethod() == 0 { // empty interface: recurse on its contents
-			return valueToInterface(v.Elem())
+		i, err := elemEnc(enc, v.Elem())
+		if err != nil {
+			return nil, encodeErr(t.Elem(), err)
 		}
-		fallthrough // any other interface value is an error
-
-	default:
-		return nil, fmt.Errorf("calcifer: cannot convert type %s to firestore value", v.Type())
+		return i, nil
 	}
 }
 
-func sliceToInterface(v reflect.Value) (interface{}, error) {
-	st := v.Type().Elem()
-	switch st.Kind() {
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		st = typeOfInt64
+// storedElemType returns the type of the elements of the slice or map that
+// holds the Firestore representations of values of type t.
+func storedElemType(t reflect.Type) reflect.Type {
+	if t == typeOfGoTime || t == typeOfByteSlice {
+		return t
+	}
+	if hasMarshalOrUnmarshalMethod(t) {
+		return typeOfInterface
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return typeOfBool
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint64:
+		return typeOfInt64
 	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
-		st = typeOfUInt32
+		return typeOfUInt32
 	case reflect.Float32, reflect.Float64:
-		st = typeOfFloat64
+		return typeOfFloat64
+	case reflect.String:
+		return typeOfString
 	case reflect.Struct:
-		st = typeOfMapStringInterface
+		return typeOfMapStringInterface
+	default: // nillable kinds
+		return typeOfInterface
 	}
-	st = reflect.SliceOf(st)
-	sv := reflect.MakeSlice(st, v.Len(), v.Len())
-	for i := 0; i < v.Len(); i++ {
-		iv, err := valueToInterface(v.Index(i))
-		if err != nil {
+}
+
+func newSliceEncoder(t reflect.Type) encoderFunc {
+	st := reflect.SliceOf(storedElemType(t.Elem()))
+	elemEnc := typeEncoder(t.Elem())
+	return func(enc *encoder, v reflect.Value) (interface{}, error) {
+		sv := reflect.MakeSlice(st, v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			iv, err := elemEnc(enc, v.Index(i))
+			if err != nil {
+				return nil, encodeErr(t.Elem(), err).in(strconv.Itoa(i))
+			}
+			if iv != nil {
+				sv.Index(i).Set(reflect.ValueOf(iv))
+			}
+		}
+		return sv.Interface(), nil
+	}
+}
+
+func newMapEncoder(t reflect.Type) encoderFunc {
+	if t.Key().Kind() != reflect.String {
+		err := fmt.Errorf("calcifer: cannot convert map with non-string key type %s to firestore value", t.Key())
+		return func(enc *encoder, v reflect.Value) (interface{}, error) {
+			if v.IsNil() {
+				return nil, nil
+			}
 			return nil, err
 		}
-		sv.Index(i).Set(reflect.ValueOf(iv))
 	}
-	return sv.Interface(), nil
+	et := storedElemType(t.Elem())
+	mt := reflect.MapOf(typeOfString, et)
+	elemEnc := typeEncoder(t.Elem())
+	return func(enc *encoder, v reflect.Value) (interface{}, error) {
+		if v.IsNil() {
+			return nil, nil
+		}
+		mv := reflect.MakeMapWithSize(mt, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			iv, err := elemEnc(enc, iter.Value())
+			if err != nil {
+				return nil, encodeErr(t.Elem(), err).in(iter.Key().String())
+			}
+			ev := reflect.Zero(et)
+			if iv != nil {
+				ev = reflect.ValueOf(iv)
+			}
+			mv.SetMapIndex(reflect.ValueOf(iter.Key().String()), ev)
+		}
+		return mv.Interface(), nil
+	}
 }
 
-func mapToInterface(v reflect.Value) (interface{}, error) {
-	return nil, errors.New("calcifer: mapToInterface: unimplemented")
+// A fieldEncoder writes one field of a struct.
+type fieldEncoder struct {
+	field
+	isRef   bool
+	enc     encoderFunc // nil for references
+	compute computeFunc // nil unless the field is computed
 }
 
-func structToInterface(v reflect.Value) (interface{}, error) {
-	fs, err := defaultFieldCache.fields(v.Type())
+func newStructEncoder(t reflect.Type) encoderFunc {
+	fs, err := defaultFieldCache.fields(t)
 	if err != nil {
-		return nil, err
+		return errorEncoder(err)
 	}
-	sm := make(map[string]interface{})
+	var (
+		fes    []fieldEncoder
+		remain []int // index of the remain field, if any
+		names  = make(map[string]bool, len(fs))
+	)
 	for _, f := range fs {
-		fv := v.FieldByIndex(f.Index)
-		if f.TagOptions.reference != "" {
-			if fv.Kind() == reflect.Slice {
-				fk, err := valueToForeignKeySlice(fv)
-				if err != nil {
-					return nil, err
-				}
-				sm[f.Name] = fk
-			} else if fv.Kind() == reflect.Map {
-				fk, err := valueToForeignKeyMap(fv)
+		if f.TagOptions.remain {
+			remain = f.Index
+			continue
+		}
+		names[f.Name] = true
+		if f.TagOptions.readonly {
+			continue
+		}
+		fe := fieldEncoder{field: f, isRef: f.TagOptions.reference != ""}
+		if !fe.isRef {
+			fe.enc = typeEncoder(f.Type)
+		}
+		if f.TagOptions.computed {
+			if fe.compute, err = computeMethod(t, f); err != nil {
+				return errorEncoder(err)
+			}
+		}
+		fes = append(fes, fe)
+	}
+	return func(enc *encoder, v reflect.Value) (interface{}, error) {
+		sm := make(map[string]interface{}, len(fes))
+		for _, f := range fes {
+			fv := v.FieldByIndex(f.Index)
+			if f.compute != nil {
+				cv, err := f.compute(v)
 				if err != nil {
-					return nil, err
+					return nil, encodeErr(f.Type, err).in(f.Name)
 				}
-				sm[f.Name] = fk
+				fv = reflect.New(f.Type).Elem()
+				fv.Set(cv)
+			}
+			if usesServerTimestamp(f.field, fv) {
+				sm[f.Name] = firestore.ServerTimestamp
+				continue
+			}
+			if f.TagOptions.omitEmpty && isEmptyValue(fv, f.isRef) {
+				continue
+			}
+			var (
+				val interface{}
+				err error
+			)
+			if f.isRef {
+				val, err = enc.referenceToInterface(fv, f.TagOptions.reference, f.TagOptions.refAs)
 			} else {
-				fk, err := valueToForeignKey(fv)
+				val, err = f.enc(enc, fv)
+			}
+			if err != nil {
+				return nil, encodeErr(f.Type, err).in(f.Name)
+			}
+			sm[f.Name] = val
+		}
+		if remain != nil {
+			// Write back the fields captured on read, unless the model now has them.
+			iter := v.FieldByIndex(remain).MapRange()
+			for iter.Next() {
+				k := iter.Key().String()
+				if names[k] {
+					continue
+				}
+				val, err := enc.valueToInterface(iter.Value())
 				if err != nil {
-					return nil, err
+					return nil, encodeErr(iter.Value().Type(), err).in(k)
 				}
-				sm[f.Name] = fk
+				sm[k] = val
 			}
-		} else {
-			val, err := valueToInterface(fv)
+		}
+		return sm, nil
+	}
+}
+
+// usesServerTimestamp reports whether the value v of field f is written as
+// firestore.ServerTimestamp, to be replaced by the time of the write.
+func usesServerTimestamp(f field, v reflect.Value) bool {
+	if !f.TagOptions.serverTimestamp || v.Type() != typeOfGoTime {
+		return false
+	}
+	return f.TagOptions.serverTimestampAlways || v.Interface().(time.Time).IsZero()
+}
+
+// setServerTimestamps sets the fields of the struct v that were written as
+// firestore.ServerTimestamp to t, the time of the write. If merged is not nil,
+// only the fields at or below those calcifer field paths were written; prefix
+// is the field path of v. It must be called before any other changes to v.
+func setServerTimestamps(v reflect.Value, t time.Time, prefix string, merged []string) error {
+	fs, err := defaultFieldCache.fields(v.Type())
+	if err != nil {
+		return err
+	}
+	for _, f := range fs {
+		if f.TagOptions.reference != "" {
+			continue
+		}
+		path := joinPath(prefix, f.Name)
+		written, partly := mergedPath(path, merged)
+		if !written && !partly {
+			continue
+		}
+		fv := v.FieldByIndex(f.Index)
+		if written && usesServerTimestamp(f, fv) {
+			fv.Set(reflect.ValueOf(t))
+			continue
+		}
+		if fv.Kind() == reflect.Pointer {
+			if fv.IsNil() {
+				continue
+			}
+			fv = fv.Elem()
+		}
+		if fv.Kind() == reflect.Struct && !isLeafType(fv.Type()) {
+			sub := merged
+			if written {
+				sub = nil
+			}
+			if err := setServerTimestamps(fv, t, path, sub); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// mergedPath reports whether the field at path is written by a merge of the
+// field paths merged, all fields if merged is nil, and whether only some of
+// the fields below it are.
+func mergedPath(path string, merged []string) (written, partly bool) {
+	if merged == nil {
+		return true, false
+	}
+	for _, p := range merged {
+		switch {
+		case p == path || strings.HasPrefix(path, p+"."):
+			return true, false
+		case strings.HasPrefix(p, path+"."):
+			partly = true
+		}
+	}
+	return false, partly
+}
+
+// isEmptyValue reports whether v is omitted from documents when its field is
+// tagged with "omitempty". A reference is empty if it has no ID.
+func isEmptyValue(v reflect.Value, reference bool) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		if v.IsNil() {
+			return true
+		}
+		return reference && isEmptyValue(v.Elem(), reference)
+	case reflect.Struct:
+		if reference {
+			id, err := valueToForeignKey(v)
+			return err == nil && id == ""
+		}
+		if t, ok := v.Interface().(time.Time); ok {
+			return t.IsZero()
+		}
+		return v.IsZero()
+	}
+	return false
+}
+
+// referenceToInterface converts the value of a field tagged with "ref:" into the
+// foreign key(s) stored in Firestore, in the form as, for documents of collection col.
+func (enc *encoder) referenceToInterface(v reflect.Value, col string, as refStorage) (interface{}, error) {
+	var (
+		ids interface{}
+		err error
+	)
+	switch v.Kind() {
+	case reflect.Slice:
+		ids, err = valueToForeignKeySlice(v)
+	case reflect.Map:
+		ids, err = valueToForeignKeyMap(v)
+	default:
+		ids, err = valueToForeignKey(v)
+	}
+	if err != nil || as == refByID {
+		return ids, err
+	}
+	return enc.storedKeys(reflect.ValueOf(ids), col, as)
+}
+
+// storedKeys converts ids, a document ID of collection col or a slice or map of
+// them, into the form as.
+func (enc *encoder) storedKeys(ids reflect.Value, col string, as refStorage) (interface{}, error) {
+	switch ids.Kind() {
+	case reflect.Slice:
+		keys := make([]interface{}, ids.Len())
+		for i := range keys {
+			k, err := enc.storedKey(ids.Index(i).String(), col, as)
 			if err != nil {
-				return nil, err
+				return nil, encodeErr(ids.Index(i).Type(), err).in(strconv.Itoa(i))
 			}
-			sm[f.Name] = val
+			keys[i] = k
 		}
+		return keys, nil
+	case reflect.Map:
+		if ids.Type().Key().Kind() != reflect.String {
+			return nil, errors.New("calcifer: keys in foreign-key maps must be strings")
+		}
+		keys := make(map[string]interface{}, ids.Len())
+		iter := ids.MapRange()
+		for iter.Next() {
+			k, err := enc.storedKey(iter.Value().String(), col, as)
+			if err != nil {
+				return nil, encodeErr(iter.Value().Type(), err).in(iter.Key().String())
+			}
+			keys[iter.Key().String()] = k
+		}
+		return keys, nil
+	default:
+		return enc.storedKey(ids.String(), col, as)
 	}
-	return sm, nil
+}
+
+// storedKey converts the ID of a document of collection col into the form as.
+// Empty IDs are stored as "", whatever the form.
+func (enc *encoder) storedKey(id, col string, as refStorage) (interface{}, error) {
+	switch {
+	case as == refByID || id == "":
+		return id, nil
+	case as == refByPath:
+		return col + "/" + id, nil
+	case enc.cli == nil || enc.cli.fs == nil:
+		return nil, errors.New("calcifer: references stored as=reference can only be written by a client")
+	}
+	return enc.cli.fs.Collection(col).Doc(id), nil
 }
 
 func valueToForeignKey(v reflect.Value) (string, error) {
@@ -152,14 +576,13 @@ func valueToForeignKey(v reflect.Value) (string, error) {
 		return valueToForeignKey(v.Elem())
 	}
 	if v.Kind() != reflect.Struct {
-		return "", errors.New("caclifer: cannot use non-struct type as foreign key reference")
+		return "", errors.New("calcifer: cannot use non-struct type as foreign key reference")
 	}
-	// TODO validate the struct embeds Model
-	sv := v.FieldByName("Model") // TODO: ensure this is a calcifer.Model?
+	sv := fieldByName(v, "Model")
 	if sv.Kind() != reflect.Struct {
 		return "", errors.New("calcifer: missing Model field on foreign key reference object")
 	}
-	sv = sv.FieldByName("ID")
+	sv = fieldByName(sv, "ID")
 	ss := sv.String()
 	if ss == "" {
 		return "", nil
@@ -177,7 +600,7 @@ func valueToForeignKeySlice(v reflect.Value) ([]string, error) {
 		}
 		fki, err := valueToForeignKey(vi)
 		if err != nil {
-			return nil, err
+			return nil, encodeErr(vi.Type(), err).in(strconv.Itoa(i))
 		}
 		fk[i] = fki
 	}
@@ -194,7 +617,7 @@ func valueToForeignKeyMap(v reflect.Value) (map[string]string, error) {
 		}
 		fkk, err := valueToForeignKey(iter.Value())
 		if err != nil {
-			return nil, err
+			return nil, encodeErr(iter.Value().Type(), err).in(k.String())
 		}
 		fk[k.String()] = fkk
 	}
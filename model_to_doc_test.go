@@ -15,10 +15,12 @@
 package calcifer
 
 import (
+	"math"
 	"reflect"
 	"testing"
 	"time"
 
+	"cloud.google.com/go/firestore"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -63,11 +65,86 @@ func TestValueToInterfacePointer(t *testing.T) {
 }
 
 func TestValueToInterfaceMap(t *testing.T) {
-	t.Skip("mapToInterface: unimplemented")
 	d := map[string]string{"a": "A", "b": "B"}
 	i, err := valueToInterface(reflect.ValueOf(d))
 	assert.NoError(t, err)
 	assert.Equal(t, d, i.(map[string]string))
+
+	var nilMap map[string]string
+	i, err = valueToInterface(reflect.ValueOf(nilMap))
+	assert.NoError(t, err)
+	assert.Nil(t, i)
+
+	i, err = valueToInterface(reflect.ValueOf(map[string]string{}))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{}, i)
+
+	_, err = valueToInterface(reflect.ValueOf(map[int]string{1: "A"}))
+	assert.Error(t, err)
+}
+
+func TestValueToInterfaceMapOfNested(t *testing.T) {
+	type coord struct {
+		X int `calcifer:"x"`
+		Y int `calcifer:"y"`
+	}
+	i, err := valueToInterface(reflect.ValueOf(map[string]coord{"a": {1, 2}}))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]map[string]interface{}{"a": {"x": int64(1), "y": int64(2)}}, i)
+
+	i, err = valueToInterface(reflect.ValueOf(map[string]*coord{"a": {1, 2}, "b": nil}))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"a": map[string]interface{}{"x": int64(1), "y": int64(2)}, "b": nil}, i)
+
+	i, err = valueToInterface(reflect.ValueOf(map[string][]int{"a": {1, 2}}))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"a": []int64{1, 2}}, i)
+
+	i, err = valueToInterface(reflect.ValueOf(map[string]any{"s": "str", "n": 3, "m": map[string]any{"k": true}, "z": nil}))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"s": "str", "n": int64(3), "m": map[string]interface{}{"k": true}, "z": nil}, i)
+
+	type key string
+	i, err = valueToInterface(reflect.ValueOf(map[key]int{"a": 1}))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{"a": 1}, i)
+}
+
+func TestMapFieldRoundTrip(t *testing.T) {
+	type coord struct {
+		X int `calcifer:"x"`
+		Y int `calcifer:"y"`
+	}
+	type testModel struct {
+		Model
+		Scores  map[string]int      `calcifer:"scores"`
+		Points  map[string]*coord   `calcifer:"points"`
+		Groups  map[string][]string `calcifer:"groups"`
+		Extra   map[string]any      `calcifer:"extra"`
+		Empty   map[string]int      `calcifer:"empty"`
+		Nil     map[string]int      `calcifer:"nil"`
+		Missing map[string]int      `calcifer:"missing"`
+	}
+	m := testModel{
+		Model:  Model{ID: "1"},
+		Scores: map[string]int{"dave": 2500},
+		Points: map[string]*coord{"home": {1, 2}, "away": nil},
+		Groups: map[string][]string{"admins": {"dave"}},
+		Extra:  map[string]any{"nested": map[string]any{"ok": true}, "list": []any{"a"}},
+		Empty:  map[string]int{},
+	}
+	i, err := modelToDoc(m)
+	assert.NoError(t, err)
+	delete(i.(map[string]interface{}), "missing")
+	s := testModel{Nil: map[string]int{"stale": 1}}
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&s), i))
+	assert.Equal(t, m.Scores, s.Scores)
+	assert.Equal(t, m.Points, s.Points)
+	assert.Equal(t, m.Groups, s.Groups)
+	assert.Equal(t, map[string]any{"nested": map[string]interface{}{"ok": true}, "list": []interface{}{"a"}}, s.Extra)
+	assert.Equal(t, map[string]int{}, s.Empty)
+	assert.Nil(t, s.Nil)
+	assert.Nil(t, s.Missing)
 }
 
 func TestValueToInterfaceStruct(t *testing.T) {
@@ -118,7 +195,6 @@ func TestRelatedModelToDoc(t *testing.T) {
 	}
 	type testModel struct {
 		Model
-		Rel      relatedModel            `calcifer:"rel,ref:foo"`
 		RelPtr   *relatedModel           `calcifer:"relptr,ref:foo"`
 		RelSlice []relatedModel          `calcifer:"relslice,ref:foo"`
 		RelMap   map[string]relatedModel `calcifer:"relmap,ref:foo"`
@@ -126,7 +202,6 @@ func TestRelatedModelToDoc(t *testing.T) {
 
 	m1 := testModel{
 		Model:    Model{ID: "1"},
-		Rel:      relatedModel{Model: Model{ID: "2"}},
 		RelPtr:   &relatedModel{Model: Model{ID: "3"}},
 		RelSlice: []relatedModel{{Model: Model{ID: "4"}}, {Model: Model{ID: "5"}}},
 		RelMap:   map[string]relatedModel{"six": {Model: Model{ID: "6"}}, "seven": {Model: Model{ID: "7"}}},
@@ -135,7 +210,6 @@ func TestRelatedModelToDoc(t *testing.T) {
 	assert.NoError(t, err)
 	im := i1.(map[string]any)
 	assert.Equal(t, "1", im["id"])
-	assert.Equal(t, "2", im["rel"])
 	assert.Equal(t, "3", im["relptr"])
 	assert.Equal(t, []string{"4", "5"}, im["relslice"])
 	assert.Equal(t, map[string]string{"six": "6", "seven": "7"}, im["relmap"])
@@ -149,3 +223,284 @@ func TestRelatedModelToDoc(t *testing.T) {
 	assert.Equal(t, "1", im["id"])
 	assert.Empty(t, im["relptr"])
 }
+
+func TestModelToDocOmitEmpty(t *testing.T) {
+	type relatedModel struct {
+		Model
+		X int `calcifer:"x"`
+	}
+	type coord struct {
+		X int `calcifer:"x"`
+		Y int `calcifer:"y"`
+	}
+	type testModel struct {
+		Model
+		Name     string                  `calcifer:"name,omitempty"`
+		ELO      int                     `calcifer:"elo_score,omitempty"`
+		Ratio    float64                 `calcifer:"ratio,omitempty"`
+		Active   bool                    `calcifer:"active,omitempty"`
+		Start    time.Time               `calcifer:"start,omitempty"`
+		Tags     []string                `calcifer:"tags,omitempty"`
+		Attrs    map[string]string       `calcifer:"attrs,omitempty"`
+		Coord    coord                   `calcifer:"coord,omitempty"`
+		CoordPtr *coord                  `calcifer:"coordptr,omitempty"`
+		RelPtr   *relatedModel           `calcifer:"relptr,ref:foo,omitempty"`
+		RelSlice []relatedModel          `calcifer:"relslice,ref:foo,omitempty"`
+		RelMap   map[string]relatedModel `calcifer:"relmap,ref:foo,omitempty"`
+		Kept     string                  `calcifer:"kept"`
+	}
+
+	m1 := testModel{
+		Model:    Model{ID: "1"},
+		CoordPtr: &coord{},
+		Tags:     []string{},
+		RelPtr:   &relatedModel{},
+		RelSlice: []relatedModel{},
+	}
+	i1, err := modelToDoc(m1)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"id":          "1",
+		"create_time": time.Time{},
+		"update_time": time.Time{},
+		"coordptr":    map[string]interface{}{"x": int64(0), "y": int64(0)},
+		"kept":        "",
+	}, i1)
+
+	m2 := testModel{
+		Model:    Model{ID: "1"},
+		Name:     "Dave",
+		ELO:      2500,
+		Ratio:    0.5,
+		Active:   true,
+		Start:    time.Date(1937, time.September, 21, 17, 0, 0, 0, time.UTC),
+		Tags:     []string{"a"},
+		Coord:    coord{X: 1},
+		RelPtr:   &relatedModel{Model: Model{ID: "3"}},
+		RelSlice: []relatedModel{{Model: Model{ID: "4"}}},
+	}
+	i2, err := modelToDoc(m2)
+	assert.NoError(t, err)
+	im := i2.(map[string]interface{})
+	assert.Equal(t, "Dave", im["name"])
+	assert.Equal(t, int64(2500), im["elo_score"])
+	assert.Equal(t, 0.5, im["ratio"])
+	assert.Equal(t, true, im["active"])
+	assert.Equal(t, m2.Start, im["start"])
+	assert.Equal(t, []string{"a"}, im["tags"])
+	assert.Equal(t, map[string]interface{}{"x": int64(1), "y": int64(0)}, im["coord"])
+	assert.Equal(t, "3", im["relptr"])
+	assert.Equal(t, []string{"4"}, im["relslice"])
+	assert.NotContains(t, im, "coordptr")
+	assert.NotContains(t, im, "relmap")
+
+	// Omitted fields are read back as zero values, whatever the struct held.
+	s := m2
+	s.Attrs = map[string]string{"k": "v"}
+	s.RelMap = map[string]relatedModel{"k": {Model: Model{ID: "5"}}}
+	s.CoordPtr = &coord{X: 9}
+	cp := s.CoordPtr
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&s), i1))
+	assert.Equal(t, testModel{Model: Model{ID: "1"}, CoordPtr: &coord{}}, s)
+	assert.True(t, cp == s.CoordPtr) // fields in the document are read as before
+}
+
+func TestModelToDocServerTimestamp(t *testing.T) {
+	type audit struct {
+		ReviewedAt time.Time `calcifer:"reviewed_at,serverTimestamp"`
+	}
+	type testModel struct {
+		Model
+		PostedAt time.Time `calcifer:"posted_at,serverTimestamp"`
+		EditedAt time.Time `calcifer:"edited_at,serverTimestamp:always"`
+		Audit    *audit    `calcifer:"audit"`
+	}
+
+	posted := time.Date(1937, time.September, 21, 17, 0, 0, 0, time.UTC)
+	m := testModel{
+		PostedAt: posted,
+		EditedAt: posted,
+		Audit:    &audit{},
+	}
+	i, err := modelToDoc(m)
+	assert.NoError(t, err)
+	im := i.(map[string]interface{})
+	assert.Equal(t, posted, im["posted_at"])
+	assert.Equal(t, firestore.ServerTimestamp, im["edited_at"])
+	assert.Equal(t, map[string]interface{}{"reviewed_at": firestore.ServerTimestamp}, im["audit"])
+
+	m.PostedAt = time.Time{}
+	i, err = modelToDoc(m)
+	assert.NoError(t, err)
+	assert.Equal(t, firestore.ServerTimestamp, i.(map[string]interface{})["posted_at"])
+
+	written := time.Date(1937, time.September, 22, 6, 0, 0, 0, time.UTC)
+	assert.NoError(t, setServerTimestamps(reflect.ValueOf(&m).Elem(), written, "", nil))
+	assert.Equal(t, written, m.PostedAt)
+	assert.Equal(t, written, m.EditedAt)
+	assert.Equal(t, written, m.Audit.ReviewedAt)
+
+	// Only the merged fields were written.
+	m = testModel{Audit: &audit{}}
+	assert.NoError(t, setServerTimestamps(reflect.ValueOf(&m).Elem(), written, "", []string{"edited_at", "audit.reviewed_at"}))
+	assert.True(t, m.PostedAt.IsZero())
+	assert.Equal(t, written, m.EditedAt)
+	assert.Equal(t, written, m.Audit.ReviewedAt)
+	m = testModel{Audit: &audit{}}
+	assert.NoError(t, setServerTimestamps(reflect.ValueOf(&m).Elem(), written, "", []string{"posted_at"}))
+	assert.Equal(t, written, m.PostedAt)
+	assert.True(t, m.EditedAt.IsZero())
+	assert.True(t, m.Audit.ReviewedAt.IsZero())
+}
+
+func TestValueToInterfaceUint(t *testing.T) {
+	i, err := valueToInterface(reflect.ValueOf(uint16(42)))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(42), i)
+
+	i, err = valueToInterface(reflect.ValueOf(uint64(42)))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), i)
+
+	_, err = valueToInterface(reflect.ValueOf(uint64(math.MaxUint64)))
+	assert.Error(t, err)
+
+	i, err = valueToInterface(reflect.ValueOf([]uint{1, 2}))
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{1, 2}, i)
+}
+
+func TestValueToInterfaceEncodeError(t *testing.T) {
+	type reading struct {
+		Count uint64 `calcifer:"count"`
+	}
+	type testModel struct {
+		Model
+		Readings map[string][]*reading `calcifer:"readings"`
+	}
+	m := testModel{Readings: map[string][]*reading{"kitchen": {{Count: 1}, {Count: math.MaxUint64}}}}
+	_, err := modelToDoc(m)
+	var ee *EncodeError
+	if assert.ErrorAs(t, err, &ee) {
+		assert.Equal(t, "readings.kitchen.1.count", ee.Field)
+		assert.Equal(t, reflect.TypeOf(uint64(0)), ee.GoType)
+		assert.ErrorContains(t, err, `overflows int64 (field "readings.kitchen.1.count")`)
+	}
+
+	_, err = modelUpdates(testModel{}, []Update{{Path: "readings.hall", Value: []*reading{{Count: math.MaxUint64}}}})
+	if assert.ErrorAs(t, err, &ee) {
+		assert.Equal(t, "readings.hall.0.count", ee.Field)
+	}
+	_, err = modelUpdates(testModel{}, []Update{{Path: "readings.hall", Value: 7}})
+	if assert.ErrorAs(t, err, &ee) {
+		assert.Equal(t, "readings.hall", ee.Field)
+		assert.Equal(t, reflect.TypeOf(0), ee.GoType)
+	}
+}
+
+func TestReferenceStorage(t *testing.T) {
+	cli := offlineClient(t)
+	fs := cli.fs
+
+	type testModel struct {
+		Model
+		Owner     *User            `calcifer:"owner,ref:users,as=path"`
+		Members   []User           `calcifer:"members,ref:users,as=path"`
+		Editor    *User            `calcifer:"editor,ref:users,as=reference"`
+		Viewers   []*User          `calcifer:"viewers,ref:users,as=reference"`
+		ByRole    map[string]*User `calcifer:"by_role,ref:users,as=reference"`
+		Reviewer  *User            `calcifer:"reviewer,ref:users,as=id"`
+		Publisher *User            `calcifer:"publisher,ref:users,as=path"`
+	}
+	m := testModel{
+		Owner:    &User{Model: Model{ID: "1"}},
+		Members:  []User{{Model: Model{ID: "2"}}, {Model: Model{ID: "3"}}},
+		Editor:   &User{Model: Model{ID: "4"}},
+		Viewers:  []*User{{Model: Model{ID: "5"}}, nil},
+		ByRole:   map[string]*User{"admin": {Model: Model{ID: "6"}}},
+		Reviewer: &User{Model: Model{ID: "7"}},
+	}
+	i, err := (&encoder{cli: cli}).modelToDoc(m)
+	assert.NoError(t, err)
+	d := i.(map[string]interface{})
+	assert.Equal(t, "users/1", d["owner"])
+	assert.Equal(t, []interface{}{"users/2", "users/3"}, d["members"])
+	assert.Equal(t, fs.Doc("users/4"), d["editor"])
+	assert.Equal(t, []interface{}{fs.Doc("users/5"), ""}, d["viewers"])
+	assert.Equal(t, map[string]interface{}{"admin": fs.Doc("users/6")}, d["by_role"])
+	assert.Equal(t, "7", d["reviewer"])
+	assert.Equal(t, "", d["publisher"])
+
+	_, err = modelToDoc(m)
+	assert.ErrorContains(t, err, "as=reference")
+
+	// Any form is read, whatever the field stores.
+	d = map[string]interface{}{
+		"owner":    fs.Doc("users/1"),
+		"members":  []interface{}{"2", "projects/test/databases/(default)/documents/users/3"},
+		"editor":   "users/4",
+		"viewers":  []interface{}{fs.Doc("users/5"), nil},
+		"by_role":  map[string]interface{}{"admin": "6"},
+		"reviewer": "users/7",
+	}
+	var m2 testModel
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&m2), d))
+	assert.Equal(t, m, m2)
+
+	err = (&decoder{}).dataToValue(reflect.ValueOf(&m2), map[string]interface{}{"owner": "groups/1"})
+	assert.ErrorContains(t, err, `"groups/1" is not a document of collection "users"`)
+
+	fu, err := (&encoder{cli: cli}).modelUpdates(m, []Update{
+		{Path: "owner", Value: "8"},
+		{Path: "viewers", Value: []string{"9"}},
+		{Path: "by_role.admin", Value: &User{Model: Model{ID: "10"}}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []firestore.Update{
+		{FieldPath: []string{"owner"}, Value: "users/8"},
+		{FieldPath: []string{"viewers"}, Value: []interface{}{fs.Doc("users/9")}},
+		{FieldPath: []string{"by_role", "admin"}, Value: fs.Doc("users/10")},
+	}, fu)
+
+	type badAs struct {
+		Model
+		Owner *User `calcifer:"owner,as=path"`
+	}
+	assert.Error(t, RegisterModel(badAs{}))
+}
+
+func benchmarkEvent() Event {
+	return Event{
+		Model:       Model{ID: "party"},
+		Description: "An Unexpected Party",
+		Attendees:   []User{{Model: Model{ID: "bilbo"}}, {Model: Model{ID: "gandalf"}}, {Model: Model{ID: "thorin"}}},
+		Beverages:   []*Beverage{{Model: Model{ID: "tea"}}, {Model: Model{ID: "ale"}}},
+		Location:    &Location{Model: Model{ID: "bag-end"}},
+		Start:       time.Date(1937, time.September, 21, 17, 0, 0, 0, time.UTC),
+		End:         time.Date(1937, time.September, 22, 06, 0, 0, 0, time.UTC),
+	}
+}
+
+func BenchmarkModelToDoc(b *testing.B) {
+	e := benchmarkEvent()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := modelToDoc(e); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRecursiveTypeRoundTrip(t *testing.T) {
+	type node struct {
+		Name     string  `calcifer:"name"`
+		Children []*node `calcifer:"children"`
+	}
+	n := node{Name: "root", Children: []*node{{Name: "a"}, {Name: "b", Children: []*node{{Name: "c"}}}}}
+	i, err := valueToInterface(reflect.ValueOf(n))
+	assert.NoError(t, err)
+
+	var n2 node
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&n2), i))
+	assert.Equal(t, n, n2)
+}
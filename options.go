@@ -0,0 +1,392 @@
+// Copyright 2022 Radiopaper Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calcifer
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// A SetOption modifies a calcifer Set operation.
+type SetOption interface {
+	applySet(*setConfig)
+}
+
+type setConfig struct {
+	merges       []merge
+	precondition *ifUnchanged
+	refresh      bool
+}
+
+func newSetConfig(opts []SetOption) *setConfig {
+	c := &setConfig{}
+	for _, opt := range opts {
+		opt.applySet(c)
+	}
+	return c
+}
+
+// MergeAll is a SetOption that causes all the fields of the model passed to Set
+// to be overwritten, leaving any other fields of the stored document untouched.
+// Foreign-key references are merged as IDs, and the entries of map fields are
+// merged individually. Readonly fields are not written, and entries removed
+// from a remain field are left in the stored document.
+var MergeAll SetOption = merge{all: true}
+
+// Merge returns a SetOption that causes only the given fields of the model passed
+// to Set to be overwritten. Other fields of the stored document are untouched.
+// Each path is a dot-separated sequence of calcifer field names, as for Update.
+func Merge(paths ...string) SetOption {
+	return merge{paths: paths}
+}
+
+type merge struct {
+	all   bool
+	paths []string
+}
+
+func (m merge) applySet(c *setConfig) {
+	c.merges = append(c.merges, m)
+}
+
+// mergedPaths returns the calcifer field paths written by a Set with options c,
+// or nil if it writes every field.
+func (c *setConfig) mergedPaths() []string {
+	if len(c.merges) != 1 || c.merges[0].all {
+		return nil
+	}
+	return c.merges[0].paths
+}
+
+// firestoreSetOptions resolves the calcifer field paths of c against the fields
+// of t, and returns the equivalent Firestore SetOptions for writing doc, the
+// encoded form of a model of type t.
+//
+// Readonly fields are never written: if t has any, a Set without merge options
+// is made to merge every other field of t, to leave them untouched, and fields
+// of t that doc omits are deleted.
+func (c *setConfig) firestoreSetOptions(t reflect.Type, doc interface{}) ([]firestore.SetOption, error) {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch len(c.merges) {
+	case 0:
+		dm, ok := doc.(map[string]interface{})
+		if !ok || !hasReadonlyFields(t, map[reflect.Type]bool{}) {
+			return nil, nil
+		}
+		var fps []firestore.FieldPath
+		overwritePaths(t, dm, nil, &fps)
+		return []firestore.SetOption{firestore.Merge(fps...)}, nil
+	case 1:
+	default:
+		return nil, errors.New("calcifer: conflicting merge options")
+	}
+	m := c.merges[0]
+	if m.all {
+		return []firestore.SetOption{firestore.MergeAll}, nil
+	}
+	var fps []firestore.FieldPath
+	for _, p := range m.paths {
+		fp, target, err := resolvePath(t, p)
+		if err != nil {
+			return nil, err
+		}
+		if target.field != nil && target.field.TagOptions.readonly {
+			return nil, fmt.Errorf("calcifer: cannot merge readonly field %q", p)
+		}
+		// A nested struct with readonly fields is merged field by field.
+		if st := target.readonlyStruct(); st != nil {
+			dm, _ := doc.(map[string]interface{})
+			sub, ok := subDoc(dm, fp)
+			if !ok {
+				return nil, fmt.Errorf("calcifer: cannot merge field %q, which has readonly fields", p)
+			}
+			overwritePaths(st, sub, fp, &fps)
+			continue
+		}
+		// Firestore requires merged paths to hold a value, so fields left out
+		// by omitempty are deleted, as by a Set without merge options.
+		if dm, ok := doc.(map[string]interface{}); ok {
+			if parent, ok := subDoc(dm, fp[:len(fp)-1]); ok {
+				if _, ok := parent[fp[len(fp)-1]]; !ok {
+					parent[fp[len(fp)-1]] = firestore.Delete
+				}
+			}
+		}
+		fps = append(fps, fp)
+	}
+	return []firestore.SetOption{firestore.Merge(fps...)}, nil
+}
+
+// subDoc returns the map stored at path fp of doc, replacing a missing or nil
+// value on the path with an empty map. It reports false if the path holds
+// another value.
+func subDoc(doc map[string]interface{}, fp firestore.FieldPath) (map[string]interface{}, bool) {
+	if doc == nil {
+		return nil, false
+	}
+	for _, k := range fp {
+		if doc[k] == nil {
+			doc[k] = map[string]interface{}{}
+		}
+		sub, ok := doc[k].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		doc = sub
+	}
+	return doc, true
+}
+
+// nestedStruct returns the struct type of field f if its value is stored as a
+// nested map, and nil otherwise.
+func nestedStruct(f field) reflect.Type {
+	t := f.Type
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if f.TagOptions.reference != "" || t.Kind() != reflect.Struct || isLeafType(t) {
+		return nil
+	}
+	return t
+}
+
+// hasReadonlyFields reports whether struct type t, or a struct nested in it,
+// has readonly fields.
+func hasReadonlyFields(t reflect.Type, visiting map[reflect.Type]bool) bool {
+	if visiting[t] {
+		return false
+	}
+	visiting[t] = true
+	fs, err := defaultFieldCache.fields(t)
+	if err != nil {
+		return false
+	}
+	for _, f := range fs {
+		if f.TagOptions.readonly {
+			return true
+		}
+		if st := nestedStruct(f); st != nil && hasReadonlyFields(st, visiting) {
+			return true
+		}
+	}
+	return false
+}
+
+// overwritePaths appends to fps the paths, below prefix, of the fields of doc
+// that overwrite those stored without touching its readonly fields. doc is the
+// encoded form of a struct of type t. Fields of t that doc omits are added to
+// doc as firestore.Delete, so that they are removed as by a Set without merge
+// options. A nil nested struct with readonly fields has its other fields
+// deleted, rather than being overwritten.
+func overwritePaths(t reflect.Type, doc map[string]interface{}, prefix firestore.FieldPath, fps *[]firestore.FieldPath) {
+	fs, _ := defaultFieldCache.fields(t)
+	names := make(map[string]bool, len(fs))
+	for _, f := range fs {
+		if f.TagOptions.remain {
+			continue
+		}
+		names[f.Name] = true
+		if f.TagOptions.readonly {
+			continue
+		}
+		path := append(prefix[:len(prefix):len(prefix)], f.Name)
+		if st := nestedStruct(f); st != nil && hasReadonlyFields(st, map[reflect.Type]bool{}) {
+			if doc[f.Name] == nil {
+				doc[f.Name] = map[string]interface{}{}
+			}
+			if sub, ok := doc[f.Name].(map[string]interface{}); ok {
+				overwritePaths(st, sub, path, fps)
+				continue
+			}
+		}
+		if _, ok := doc[f.Name]; !ok {
+			doc[f.Name] = firestore.Delete
+		}
+		*fps = append(*fps, path)
+	}
+	// Entries of a remain field.
+	var rest []string
+	for k := range doc {
+		if !names[k] {
+			rest = append(rest, k)
+		}
+	}
+	sort.Strings(rest)
+	for _, k := range rest {
+		*fps = append(*fps, append(prefix[:len(prefix):len(prefix)], k))
+	}
+}
+
+// A CreateOption modifies a calcifer Create operation.
+type CreateOption interface {
+	applyCreate(*createConfig)
+}
+
+type createConfig struct {
+	refresh bool
+}
+
+func newCreateConfig(opts []CreateOption) *createConfig {
+	c := &createConfig{}
+	for _, opt := range opts {
+		opt.applyCreate(c)
+	}
+	return c
+}
+
+// A RefreshOption is both a SetOption and a CreateOption.
+type RefreshOption interface {
+	SetOption
+	CreateOption
+}
+
+// RefreshServerTimestamps returns an option that makes Set or Create store the
+// time assigned by Firestore in the written model's UpdateTime and in those of
+// its fields that were written as server timestamps. The model must be passed
+// by pointer. Write times are not known until a transaction commits, so the
+// option cannot be used in transactions, nor with IfUnchanged, which makes Set
+// run in one.
+func RefreshServerTimestamps() RefreshOption {
+	return refreshServerTimestamps{}
+}
+
+type refreshServerTimestamps struct{}
+
+func (refreshServerTimestamps) applySet(c *setConfig)       { c.refresh = true }
+func (refreshServerTimestamps) applyCreate(c *createConfig) { c.refresh = true }
+
+var (
+	errRefreshInTransaction = errors.New("calcifer: RefreshServerTimestamps cannot be used in a transaction")
+	errRefreshWithRead      = errors.New("calcifer: RefreshServerTimestamps cannot be used with IfUnchanged")
+)
+
+// An UpdateOption modifies a calcifer Update operation.
+type UpdateOption interface {
+	applyUpdate(*updateConfig)
+}
+
+type updateConfig struct {
+	precondition *ifUnchanged
+}
+
+func newUpdateConfig(opts []UpdateOption) *updateConfig {
+	c := &updateConfig{}
+	for _, opt := range opts {
+		opt.applyUpdate(c)
+	}
+	return c
+}
+
+// A DeleteOption modifies a calcifer Delete operation.
+type DeleteOption interface {
+	applyDelete(*deleteConfig)
+}
+
+type deleteConfig struct {
+	precondition *ifUnchanged
+}
+
+func newDeleteConfig(opts []DeleteOption) *deleteConfig {
+	c := &deleteConfig{}
+	for _, opt := range opts {
+		opt.applyDelete(c)
+	}
+	return c
+}
+
+// A ReadOption modifies a calcifer read: a Get, or a DocumentIterator's Next or GetAll.
+type ReadOption interface {
+	applyRead(*readConfig)
+}
+
+type readConfig struct {
+	expand      *expansion // reference fields to expand, all by default
+	maxDepth    int
+	depthPolicy DepthPolicy
+	missing     MissingPolicy
+	report      *[]MissingReference // if not nil, where to report missing references
+}
+
+func newReadConfig(opts []ReadOption) *readConfig {
+	c := &readConfig{maxDepth: DefaultMaxExpandDepth}
+	for _, opt := range opts {
+		opt.applyRead(c)
+	}
+	if c.expand == nil {
+		c.expand = expandEverything
+	}
+	return c
+}
+
+// A Precondition makes a Set, Update or Delete conditional on the state of the
+// stored document.
+type Precondition interface {
+	SetOption
+	UpdateOption
+	DeleteOption
+}
+
+// IfUnchanged returns a Precondition that makes a write fail with a *ConflictError
+// if the document has been modified since m was read, that is, if its update time
+// is not m.UpdateTime. If m.UpdateTime is zero, m is taken to be a new model, and
+// Set fails if the document exists.
+//
+// Firestore does not support preconditions on set operations, so Set with
+// IfUnchanged reads the document in a transaction before writing it. Within a
+// Transaction, the read must come before any writes.
+func IfUnchanged(m ReadableModel) Precondition {
+	return &ifUnchanged{updateTime: m.updateTime()}
+}
+
+type ifUnchanged struct {
+	updateTime time.Time
+}
+
+func (p *ifUnchanged) applySet(c *setConfig)       { c.precondition = p }
+func (p *ifUnchanged) applyUpdate(c *updateConfig) { c.precondition = p }
+func (p *ifUnchanged) applyDelete(c *deleteConfig) { c.precondition = p }
+
+// firestorePreconditions returns the Firestore preconditions equivalent to p,
+// which may be nil.
+func (p *ifUnchanged) firestorePreconditions() ([]firestore.Precondition, error) {
+	if p == nil {
+		return nil, nil
+	}
+	if p.updateTime.IsZero() {
+		return nil, errors.New("calcifer: IfUnchanged requires a model read from Firestore")
+	}
+	return []firestore.Precondition{firestore.LastUpdateTime(p.updateTime)}, nil
+}
+
+// check reports a conflict if doc is not in the state required by p.
+func (p *ifUnchanged) check(doc *firestore.DocumentSnapshot) error {
+	if p.updateTime.IsZero() {
+		if doc.Exists() {
+			return &ConflictError{Path: doc.Ref.Path}
+		}
+		return nil
+	}
+	if !doc.Exists() || !doc.UpdateTime.Equal(p.updateTime) {
+		return &ConflictError{Path: doc.Ref.Path}
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+// Copyright 2022 Radiopaper Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calcifer
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetOptions(t *testing.T) {
+	typ := reflect.TypeOf(Event{})
+
+	fopts, err := newSetConfig(nil).firestoreSetOptions(typ, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, fopts)
+
+	fopts, err = newSetConfig([]SetOption{MergeAll}).firestoreSetOptions(typ, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []firestore.SetOption{firestore.MergeAll}, fopts)
+
+	fopts, err = newSetConfig([]SetOption{Merge("Description", "location")}).firestoreSetOptions(reflect.PointerTo(typ), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []firestore.SetOption{firestore.Merge([]string{"Description"}, []string{"location"})}, fopts)
+
+	_, err = newSetConfig([]SetOption{Merge("description")}).firestoreSetOptions(typ, nil)
+	assert.Error(t, err)
+
+	_, err = newSetConfig([]SetOption{MergeAll, Merge("location")}).firestoreSetOptions(typ, nil)
+	assert.Error(t, err)
+
+	// Merged fields left out by omitempty are deleted.
+	d := encodeDoc(t, post{Body: "Hi"})
+	assert.NotContains(t, d, "title")
+	fopts, err = newSetConfig([]SetOption{Merge("body", "title")}).firestoreSetOptions(reflect.TypeOf(post{}), d)
+	assert.NoError(t, err)
+	assert.Equal(t, []firestore.SetOption{firestore.Merge([]string{"body"}, []string{"title"})}, fopts)
+	assert.Equal(t, firestore.Delete, d["title"])
+	assert.Equal(t, "Hi", d["body"])
+}
+
+type moderation struct {
+	Flagged  bool   `calcifer:"flagged,readonly"`
+	Reviewer string `calcifer:"reviewer"`
+}
+
+type post struct {
+	Model
+	Body       string                 `calcifer:"body"`
+	Title      string                 `calcifer:"title,omitempty"`
+	Likes      int                    `calcifer:"likes,readonly"`
+	SearchKey  string                 `calcifer:"search_key,writeonly"`
+	Moderation moderation             `calcifer:"moderation"`
+	Extra      map[string]interface{} `calcifer:",remain"`
+}
+
+// encodeDoc returns the encoded form of model m.
+func encodeDoc(t *testing.T, m ReadableModel) map[string]interface{} {
+	i, err := modelToDoc(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return i.(map[string]interface{})
+}
+
+func TestReadonlyWriteonlyFields(t *testing.T) {
+	p := post{
+		Body:       "Hello",
+		Likes:      3,
+		SearchKey:  "hello",
+		Moderation: moderation{Flagged: true, Reviewer: "dave"},
+		Extra:      map[string]interface{}{"legacy": "x", "likes": int64(7)},
+	}
+	i, err := modelToDoc(p)
+	assert.NoError(t, err)
+	d := i.(map[string]interface{})
+	assert.NotContains(t, d, "likes")
+	assert.Equal(t, "hello", d["search_key"])
+	assert.Equal(t, map[string]interface{}{"reviewer": "dave"}, d["moderation"])
+
+	// Without merge options, every field but the readonly ones is overwritten,
+	// and omitted fields are deleted.
+	fopts, err := newSetConfig(nil).firestoreSetOptions(reflect.TypeOf(&p), d)
+	assert.NoError(t, err)
+	assert.Equal(t, []firestore.SetOption{firestore.Merge(
+		[]string{"body"}, []string{"title"}, []string{"search_key"}, []string{"moderation", "reviewer"},
+		[]string{"id"}, []string{"create_time"}, []string{"update_time"}, []string{"schema_version"},
+		[]string{"legacy"},
+	)}, fopts)
+	assert.Equal(t, firestore.Delete, d["title"])
+	assert.Equal(t, firestore.Delete, d["schema_version"])
+
+	// A nil nested struct keeps its readonly fields.
+	type draft struct {
+		Model
+		Body       string      `calcifer:"body"`
+		Moderation *moderation `calcifer:"moderation"`
+	}
+	d = encodeDoc(t, draft{Body: "Hi"})
+	fopts, err = newSetConfig(nil).firestoreSetOptions(reflect.TypeOf(draft{}), d)
+	assert.NoError(t, err)
+	assert.Equal(t, []firestore.SetOption{firestore.Merge(
+		[]string{"body"}, []string{"moderation", "reviewer"},
+		[]string{"id"}, []string{"create_time"}, []string{"update_time"}, []string{"schema_version"},
+	)}, fopts)
+	assert.Equal(t, map[string]interface{}{"reviewer": firestore.Delete}, d["moderation"])
+
+	_, err = newSetConfig([]SetOption{Merge("likes")}).firestoreSetOptions(reflect.TypeOf(p), d)
+	assert.Error(t, err)
+	_, err = modelUpdates(p, []Update{{Path: "likes", Value: 4}})
+	assert.Error(t, err)
+	_, err = modelUpdates(p, []Update{{Path: "search_key", Value: "bye"}})
+	assert.NoError(t, err)
+
+	// A nested struct with readonly fields is written field by field.
+	d = encodeDoc(t, p)
+	fopts, err = newSetConfig([]SetOption{Merge("body", "moderation")}).firestoreSetOptions(reflect.TypeOf(p), d)
+	assert.NoError(t, err)
+	assert.Equal(t, []firestore.SetOption{firestore.Merge([]string{"body"}, []string{"moderation", "reviewer"})}, fopts)
+	d = encodeDoc(t, draft{})
+	fopts, err = newSetConfig([]SetOption{Merge("moderation")}).firestoreSetOptions(reflect.TypeOf(draft{}), d)
+	assert.NoError(t, err)
+	assert.Equal(t, []firestore.SetOption{firestore.Merge([]string{"moderation", "reviewer"})}, fopts)
+	assert.Equal(t, map[string]interface{}{"reviewer": firestore.Delete}, d["moderation"])
+
+	fus, err := modelUpdates(p, []Update{{Path: "moderation", Value: moderation{Flagged: true, Reviewer: "eve"}}})
+	assert.NoError(t, err)
+	assert.Equal(t, []firestore.Update{{FieldPath: []string{"moderation", "reviewer"}, Value: "eve"}}, fus)
+	fus, err = modelUpdates(draft{}, []Update{{Path: "moderation", Value: firestore.Delete}})
+	assert.NoError(t, err)
+	assert.Equal(t, []firestore.Update{{FieldPath: []string{"moderation", "reviewer"}, Value: firestore.Delete}}, fus)
+
+	var p2 post
+	assert.NoError(t, (&decoder{}).dataToValue(reflect.ValueOf(&p2), map[string]interface{}{
+		"body":       "Hello",
+		"likes":      int64(3),
+		"search_key": "hello",
+		"moderation": map[string]interface{}{"flagged": true},
+	}))
+	assert.Equal(t, 3, p2.Likes)
+	assert.Equal(t, "", p2.SearchKey)
+	assert.True(t, p2.Moderation.Flagged)
+
+	type conflicting struct {
+		Model
+		Likes int `calcifer:"likes,readonly,writeonly"`
+	}
+	assert.Error(t, RegisterModel(conflicting{}))
+}
+
+func TestIfUnchangedPreconditions(t *testing.T) {
+	var e Event
+	preconds, err := newUpdateConfig(nil).precondition.firestorePreconditions()
+	assert.NoError(t, err)
+	assert.Empty(t, preconds)
+
+	_, err = newUpdateConfig([]UpdateOption{IfUnchanged(e)}).precondition.firestorePreconditions()
+	assert.Error(t, err)
+
+	e.UpdateTime = time.Date(1937, time.September, 21, 17, 0, 0, 0, time.UTC)
+	preconds, err = newDeleteConfig([]DeleteOption{IfUnchanged(&e)}).precondition.firestorePreconditions()
+	assert.NoError(t, err)
+	assert.Equal(t, []firestore.Precondition{firestore.LastUpdateTime(e.UpdateTime)}, preconds)
+
+	assert.Equal(t, e.UpdateTime, newSetConfig([]SetOption{IfUnchanged(e), MergeAll}).precondition.updateTime)
+}
+
+type hall struct {
+	Model
+
+	Name  string `calcifer:"name"`
+	Owner *User  `calcifer:"owner,ref:users"`
+}
+
+type party struct {
+	Model
+
+	Hall   *hall  `calcifer:"hall,ref:halls"`
+	Guests []User `calcifer:"guests,ref:users"`
+}
+
+func TestReadOptions(t *testing.T) {
+	partyType, hallType := reflect.TypeOf(party{}), reflect.TypeOf(hall{})
+	names := func(fs fieldList) []string {
+		var ns []string
+		for _, f := range fs {
+			ns = append(ns, f.Name)
+		}
+		return ns
+	}
+
+	sel := newReadConfig(nil).expand
+	fs, err := sel.expandedFields(partyType)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"hall", "guests"}, names(fs))
+	assert.Same(t, sel, sel.field("hall"))
+
+	sel = newReadConfig([]ReadOption{NoExpand()}).expand
+	fs, err = sel.expandedFields(partyType)
+	assert.NoError(t, err)
+	assert.Empty(t, fs)
+
+	sel = newReadConfig([]ReadOption{Expand("hall.owner")}).expand
+	fs, err = sel.expandedFields(partyType)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"hall"}, names(fs))
+	fs, err = sel.field("hall").expandedFields(hallType)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"owner"}, names(fs))
+	fs, err = sel.field("hall").field("owner").expandedFields(reflect.TypeOf(User{}))
+	assert.NoError(t, err)
+	assert.Empty(t, fs)
+
+	// Options are combined.
+	sel = newReadConfig([]ReadOption{Expand("hall"), NoExpand(), Expand("guests")}).expand
+	fs, err = sel.expandedFields(partyType)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"hall", "guests"}, names(fs))
+	fs, err = sel.field("hall").expandedFields(hallType)
+	assert.NoError(t, err)
+	assert.Empty(t, fs)
+
+	sel = newReadConfig([]ReadOption{Expand("hall.name")}).expand
+	_, err = sel.field("hall").expandedFields(hallType)
+	assert.ErrorContains(t, err, `cannot expand "name": not a reference field`)
+	sel = newReadConfig([]ReadOption{Expand("guest")}).expand
+	_, err = sel.expandedFields(partyType)
+	assert.ErrorContains(t, err, `cannot expand "guest"`)
+
+	// Paths are checked to their ends, whether or not there are models there.
+	sel = newReadConfig([]ReadOption{Expand("hall.ownr")}).expand
+	_, err = sel.expandedFields(partyType)
+	assert.ErrorContains(t, err, `cannot expand "hall.ownr": not a reference field of type calcifer.hall`)
+	sel = newReadConfig([]ReadOption{Expand("guests.owner")}).expand
+	_, err = sel.expandedFields(partyType)
+	assert.ErrorContains(t, err, `cannot expand "guests.owner"`)
+	e, counts := fakeExpander(t, fakeStore{"parties/1": func() MutableModel { return &party{Model: Model{ID: "1"}} }})
+	err = readFake(e, "parties/1", &party{}, Expand("hall.ownr"))
+	assert.ErrorContains(t, err, `cannot expand "hall.ownr"`)
+	assert.Zero(t, counts.roundTrips)
+}
@@ -96,28 +96,24 @@ type DocumentIterator struct {
 // If error is iterator.Done, no result is unmarshalled. Once Next returns Done,
 // all subsequent calls will return
 // Done.
-func (it *DocumentIterator) Next(ctx context.Context, p MutableModel) error {
+func (it *DocumentIterator) Next(ctx context.Context, p MutableModel, opts ...ReadOption) error {
 	doc, err := it.it.Next()
 	if err != nil {
 		return err
 	}
-	if err := docToModel(p, doc); err != nil {
+	if err := it.decode(ctx, p, doc); err != nil {
 		return err
 	}
 
-	// TODO: make expansion optional
-	expandFunc := it.cli.expandModel
-	if it.tx != nil { // expand in the same transaction
-		expandFunc = it.tx.cli.expandModel
-	}
-	if err := expandFunc(ctx, p); err != nil {
+	rc := newReadConfig(opts)
+	if err := it.expander(rc).expand(ctx, p, doc, rc.expand); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (it *DocumentIterator) GetAll(ctx context.Context, p any) error {
+func (it *DocumentIterator) GetAll(ctx context.Context, p any, opts ...ReadOption) error {
 	docs, err := it.it.GetAll()
 	if err != nil {
 		return err
@@ -129,19 +125,33 @@ func (it *DocumentIterator) GetAll(ctx context.Context, p any) error {
 
 	for i, doc := range docs {
 		mm := newSlice.Index(i).Addr().Interface().(MutableModel)
-		err := docToModel(mm, doc)
+		err := it.decode(ctx, mm, doc)
 		if err != nil {
 			return err
 		}
 	}
 	if len(docs) > 0 {
-		expandFunc := it.cli.expandAll
-		if it.tx != nil { // expand in the same transaction
-			expandFunc = it.tx.cli.expandAll
-		}
-		if err := expandFunc(ctx, p); err != nil {
+		rc := newReadConfig(opts)
+		if err := it.expander(rc).expandAll(ctx, newSlice, docs, rc.expand); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// expander returns an expander for a read by the iterator with configuration rc,
+// which reads in the iterator's transaction, if it has one.
+func (it *DocumentIterator) expander(rc *readConfig) *expander {
+	if it.tx != nil {
+		return it.tx.newExpander(rc)
+	}
+	return it.cli.newExpander(rc)
+}
+
+// decode populates m from doc, which was read by the iterator.
+func (it *DocumentIterator) decode(ctx context.Context, m MutableModel, doc *firestore.DocumentSnapshot) error {
+	if it.tx != nil {
+		return it.cli.docToModel(m, doc)
+	}
+	return it.cli.readModel(ctx, m, doc)
+}
@@ -16,35 +16,70 @@ package calcifer
 
 import (
 	"context"
+	"reflect"
 
 	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type Transaction struct {
-	tx  *firestore.Transaction
-	cli *Client
+	tx          *firestore.Transaction
+	cli         *Client
+	created     []*DocumentRef // documents written with Create
+	conditional []*DocumentRef // documents written with a Firestore precondition
+	onCommit    []func()       // changes to models to make if the transaction commits
 }
 
 type TransactionOption any
 
 func (c *Client) RunTransaction(ctx context.Context, f func(context.Context, *Transaction) error, opts ...TransactionOption) (err error) {
-	return c.fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
-		t := &Transaction{tx, c}
+	var t *Transaction
+	err = c.fs.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		t = &Transaction{tx: tx, cli: c}
 		return f(ctx, t)
 	})
+	if t == nil {
+		return err
+	}
+	if err == nil {
+		for _, f := range t.onCommit {
+			f()
+		}
+		return nil
+	}
+	switch status.Code(err) {
+	case codes.AlreadyExists:
+		if len(t.created) > 0 {
+			return &AlreadyExistsError{Path: solePath(t.created), err: err}
+		}
+	case codes.FailedPrecondition:
+		if len(t.conditional) > 0 {
+			return &ConflictError{Path: solePath(t.conditional), err: err}
+		}
+	}
+	return err
+}
+
+// solePath returns the path of the only document in drs, or "" if there are several.
+func solePath(drs []*DocumentRef) string {
+	if len(drs) != 1 {
+		return ""
+	}
+	return drs[0].Path
 }
 
-func (tx *Transaction) Get(dr *DocumentRef, m MutableModel) error {
+func (tx *Transaction) Get(dr *DocumentRef, m MutableModel, opts ...ReadOption) error {
 	doc, err := tx.tx.Get(dr.DocumentRef)
 	if err != nil {
 		return err
 	}
-	if err := docToModel(m, doc); err != nil {
+	if err := tx.cli.docToModel(m, doc); err != nil {
 		return err
 	}
 
-	// TODO: make expansion optional
-	if err := tx.expandModel(m); err != nil {
+	rc := newReadConfig(opts)
+	if err := tx.newExpander(rc).expand(context.Background(), m, doc, rc.expand); err != nil {
 		return err
 	}
 	// TODO: configurable retry-loops
@@ -52,18 +87,102 @@ func (tx *Transaction) Get(dr *DocumentRef, m MutableModel) error {
 }
 
 func (tx *Transaction) Documents(q Queryer) *DocumentIterator {
-	return &DocumentIterator{tx: tx, it: tx.tx.Documents(q.query().q)}
+	return &DocumentIterator{cli: tx.cli, tx: tx, it: tx.tx.Documents(q.query().q)}
+}
+
+// Set writes a Model to Firestore at the path referred to by dr, as
+// DocumentRef.Set does. Set with IfUnchanged reads the document, so it must
+// come before any writes in the transaction.
+func (tx *Transaction) Set(dr *DocumentRef, m ReadableModel, opts ...SetOption) error {
+	c := newSetConfig(opts)
+	if c.refresh {
+		return errRefreshInTransaction
+	}
+	if err := checkSet(m, c); err != nil {
+		return err
+	}
+	return tx.set(dr, m, c)
 }
 
-func (tx *Transaction) Set(dr *DocumentRef, m ReadableModel) error {
-	sm, err := modelToDoc(m)
+func (tx *Transaction) set(dr *DocumentRef, m ReadableModel, c *setConfig) error {
+	sm, err := (&encoder{cli: tx.cli}).modelToDoc(m)
+	if err != nil {
+		return inDocument(err, dr.Path)
+	}
+	fopts, err := c.firestoreSetOptions(reflect.TypeOf(m), sm)
 	if err != nil {
 		return err
 	}
+	if c.precondition != nil {
+		docs, err := tx.tx.GetAll([]*firestore.DocumentRef{dr.DocumentRef})
+		if err != nil {
+			return err
+		}
+		if err := c.precondition.check(docs[0]); err != nil {
+			return err
+		}
+	}
 	// TODO: transactionally store model history
-	return tx.tx.Set(dr.DocumentRef, sm)
+	return tx.tx.Set(dr.DocumentRef, sm, fopts...)
 }
 
-func (tx *Transaction) Delete(dr *DocumentRef) error {
-	return tx.tx.Delete(dr.DocumentRef)
+// Create writes a Model to Firestore at the path referred to by dr, causing the
+// transaction to fail with an *AlreadyExistsError if the document already exists.
+// The ID of m is set to that of dr once the transaction commits; its CreateTime
+// and UpdateTime are not known then, and are left unchanged.
+func (tx *Transaction) Create(dr *DocumentRef, m MutableModel, opts ...CreateOption) error {
+	if newCreateConfig(opts).refresh {
+		return errRefreshInTransaction
+	}
+	cm := withID(m, dr.ID)
+	if err := checkModel(cm); err != nil {
+		return err
+	}
+	sm, err := (&encoder{cli: tx.cli}).modelToDoc(cm)
+	if err != nil {
+		return inDocument(err, dr.Path)
+	}
+	// TODO: transactionally store model history
+	if err := tx.tx.Create(dr.DocumentRef, sm); err != nil {
+		return err
+	}
+	tx.created = append(tx.created, dr)
+	tx.onCommit = append(tx.onCommit, func() { m.setID(dr.ID) })
+	return nil
+}
+
+// Update applies updates to the fields of the document referred to by dr, leaving
+// its other fields untouched. The paths of the updates are resolved against the
+// fields of m's type; m's field values are not written. The document must exist.
+func (tx *Transaction) Update(dr *DocumentRef, m ReadableModel, updates []Update, opts ...UpdateOption) error {
+	fu, err := (&encoder{cli: tx.cli}).modelUpdates(m, updates)
+	if err != nil {
+		return inDocument(err, dr.Path)
+	}
+	preconds, err := newUpdateConfig(opts).precondition.firestorePreconditions()
+	if err != nil {
+		return err
+	}
+	// TODO: transactionally store model history
+	if err := tx.tx.Update(dr.DocumentRef, fu, preconds...); err != nil {
+		return err
+	}
+	if len(preconds) > 0 {
+		tx.conditional = append(tx.conditional, dr)
+	}
+	return nil
+}
+
+func (tx *Transaction) Delete(dr *DocumentRef, opts ...DeleteOption) error {
+	preconds, err := newDeleteConfig(opts).precondition.firestorePreconditions()
+	if err != nil {
+		return err
+	}
+	if err := tx.tx.Delete(dr.DocumentRef, preconds...); err != nil {
+		return err
+	}
+	if len(preconds) > 0 {
+		tx.conditional = append(tx.conditional, dr)
+	}
+	return nil
 }
@@ -160,3 +160,59 @@ func TestTransactionalQueries(t *testing.T) {
 
 	assert.Equal(t, []int{3, 4, 5}, ns)
 }
+
+func TestTransactionalQueryExpansion(t *testing.T) {
+	ctx := context.Background()
+	cli := testClient(t)
+
+	locationRef := cli.Collection("locations").NewDoc()
+	assert.NoError(t, locationRef.Set(ctx, Location{Name: "The Prancing Pony, Bree"}))
+	userRef := cli.Collection("users").NewDoc()
+	assert.NoError(t, userRef.Set(ctx, User{Email: "strider@bree.net"}))
+	assert.NoError(t, cli.Collection("events").NewDoc().Set(ctx, Event{
+		Description: "A Meeting at the Prancing Pony",
+		Location:    &Location{Model: Model{ID: locationRef.ID}},
+		Attendees:   []User{{Model: Model{ID: userRef.ID}}},
+	}))
+
+	q := cli.Collection("events").Where("Description", "==", "A Meeting at the Prancing Pony")
+	var all []Event
+	var next Event
+	err := cli.RunTransaction(ctx, func(ctx context.Context, tx *Transaction) error {
+		if err := tx.Documents(q).GetAll(ctx, &all); err != nil {
+			return err
+		}
+		return tx.Documents(q).Next(ctx, &next)
+	})
+	assert.NoError(t, err)
+
+	if assert.Len(t, all, 1) {
+		assert.Equal(t, "The Prancing Pony, Bree", all[0].Location.Name)
+		assert.Equal(t, "strider@bree.net", all[0].Attendees[0].Email)
+	}
+	assert.Equal(t, "The Prancing Pony, Bree", next.Location.Name)
+	assert.Equal(t, "strider@bree.net", next.Attendees[0].Email)
+
+	// A transaction cannot read after it writes, but an iterator created before
+	// the write can still run its query. Expanding its results then fails only
+	// if the referenced documents are read in the transaction.
+	write := func(tx *Transaction) error {
+		return tx.Set(cli.Collection("users").NewDoc(), User{Email: "butterbur@bree.net"})
+	}
+	err = cli.RunTransaction(ctx, func(ctx context.Context, tx *Transaction) error {
+		it := tx.Documents(q)
+		if err := write(tx); err != nil {
+			return err
+		}
+		return it.GetAll(ctx, &all, NoExpand())
+	})
+	assert.NoError(t, err)
+	err = cli.RunTransaction(ctx, func(ctx context.Context, tx *Transaction) error {
+		it := tx.Documents(q)
+		if err := write(tx); err != nil {
+			return err
+		}
+		return it.GetAll(ctx, &all)
+	})
+	assert.ErrorContains(t, err, "read after write")
+}
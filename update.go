@@ -0,0 +1,268 @@
+// Copyright 2022 Radiopaper Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calcifer
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+)
+
+// An Update describes an update to a single field of a document.
+//
+// Path is a dot-separated sequence of calcifer field names, as given by the
+// `calcifer:"..."` struct tags of the model, e.g. "location" or "address.city".
+// Path segments following a map-valued field are map keys.
+//
+// Value is encoded the same way as by Set. Values of foreign-key fields may be
+// given either as models, whose IDs are stored, or directly as string IDs.
+// Numbers may be of any numeric type that converts to the type of their field
+// without losing information.
+// To delete a field, use firestore.Delete as the value.
+//
+// Values are checked against the constraints in the struct tags of their fields
+// and by their Validate methods, as for Set.
+type Update struct {
+	Path  string
+	Value interface{}
+}
+
+// A pathTarget describes the Go value addressed by a calcifer field path.
+type pathTarget struct {
+	typ       reflect.Type // Go type of the addressed value
+	reference string       // collection referenced by the value, if any
+	refAs     refStorage   // form in which the reference is stored
+	field     *field       // struct field holding the value, if not a map entry
+}
+
+// resolvePath translates a dot-separated path of calcifer field names on type t
+// into a Firestore field path, rejecting paths that don't name a field of t.
+func resolvePath(t reflect.Type, path string) (firestore.FieldPath, pathTarget, error) {
+	if path == "" {
+		return nil, pathTarget{}, fmt.Errorf("calcifer: empty field path for type %s", t)
+	}
+	parts := strings.Split(path, ".")
+	target := pathTarget{typ: t}
+	for _, p := range parts {
+		if p == "" {
+			return nil, pathTarget{}, fmt.Errorf("calcifer: empty segment in field path %q", path)
+		}
+		typ := target.typ
+		if typ.Kind() == reflect.Pointer {
+			typ = typ.Elem()
+		}
+		switch {
+		case typ.Kind() == reflect.Map:
+			if typ.Key().Kind() != reflect.String {
+				return nil, pathTarget{}, fmt.Errorf("calcifer: field path %q indexes map with non-string keys", path)
+			}
+			target = pathTarget{typ: typ.Elem(), reference: target.reference, refAs: target.refAs}
+		case target.reference != "":
+			return nil, pathTarget{}, fmt.Errorf("calcifer: field path %q descends into a referenced document", path)
+		case typ.Kind() == reflect.Struct && !isLeafType(typ):
+			fs, err := defaultFieldCache.fields(typ)
+			if err != nil {
+				return nil, pathTarget{}, err
+			}
+			f, ok := fs.byName(p)
+			if !ok {
+				return nil, pathTarget{}, fmt.Errorf("calcifer: type %s has no field %q (in path %q)", typ, p, path)
+			}
+			target = pathTarget{typ: f.Type, reference: f.TagOptions.reference, refAs: f.TagOptions.refAs, field: &f}
+		default:
+			return nil, pathTarget{}, fmt.Errorf("calcifer: field path %q descends into non-struct type %s", path, typ)
+		}
+	}
+	return firestore.FieldPath(parts), target, nil
+}
+
+// readonlyStruct returns the struct type of the value addressed by target if it
+// is stored as a nested map with readonly fields, which writing the value whole
+// would overwrite, and nil otherwise.
+func (target pathTarget) readonlyStruct() reflect.Type {
+	t := target.typ
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if target.reference != "" || t.Kind() != reflect.Struct || isLeafType(t) || !hasReadonlyFields(t, map[reflect.Type]bool{}) {
+		return nil
+	}
+	return t
+}
+
+// encodeUpdateValue converts value into the Firestore representation of the
+// Go value addressed by target, returning an *EncodeError on failure.
+func (enc *encoder) encodeUpdateValue(target pathTarget, path string, value interface{}) (interface{}, error) {
+	if value == nil || isFirestoreSentinel(value) {
+		return value, nil
+	}
+	v := reflect.ValueOf(value)
+	typ := target.typ
+	if target.reference != "" && isForeignKeyValue(typ, v.Type()) {
+		if target.refAs == refByID {
+			return value, nil
+		}
+		i, err := enc.storedKeys(v, target.reference, target.refAs)
+		if err != nil {
+			return nil, encodeErr(v.Type(), err).in(path)
+		}
+		return i, nil
+	}
+	if typ.Kind() == reflect.Pointer && v.Kind() != reflect.Pointer {
+		typ = typ.Elem()
+	}
+	if !v.Type().AssignableTo(typ) {
+		switch {
+		case isNumber(v) && isNumber(reflect.Zero(typ)):
+			nv, err := convertNumber(v, typ)
+			if err != nil {
+				return nil, encodeErr(v.Type(), err).in(path)
+			}
+			v = nv
+		case v.Kind() != typ.Kind() || !v.Type().ConvertibleTo(typ):
+			err := fmt.Errorf("calcifer: cannot use value of type %s for field of type %s", v.Type(), target.typ)
+			return nil, encodeErr(v.Type(), err).in(path)
+		default:
+			v = v.Convert(typ)
+		}
+	}
+	var (
+		i   interface{}
+		err error
+	)
+	if target.reference != "" {
+		i, err = enc.referenceToInterface(v, target.reference, target.refAs)
+	} else {
+		i, err = enc.valueToInterface(v)
+	}
+	if err != nil {
+		return nil, encodeErr(v.Type(), err).in(path)
+	}
+	return i, nil
+}
+
+// leafValue returns the value at path fp of the nested maps of doc.
+func leafValue(doc map[string]interface{}, fp firestore.FieldPath) interface{} {
+	for _, k := range fp[:len(fp)-1] {
+		doc = doc[k].(map[string]interface{})
+	}
+	return doc[fp[len(fp)-1]]
+}
+
+// convertNumber converts the numeric value v to the numeric type t, failing if
+// the conversion would lose information, as when reading documents.
+func convertNumber(v reflect.Value, t reflect.Type) (reflect.Value, error) {
+	nv := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := numberToInt(v, t)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		nv.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := numberToUint(v, t)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		nv.SetUint(u)
+	default:
+		f, err := numberToFloat(v, t)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		nv.SetFloat(f)
+	}
+	return nv, nil
+}
+
+// isForeignKeyValue reports whether a value of type vt holds the stored form of a
+// reference field of type t: a string ID, or a slice or map of string IDs.
+func isForeignKeyValue(t, vt reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Slice, reflect.Map:
+		return vt.Kind() == t.Kind() && vt.Elem().Kind() == reflect.String
+	default:
+		return vt.Kind() == reflect.String
+	}
+}
+
+// isFirestoreSentinel reports whether v is one of the special values, such as
+// firestore.Delete, firestore.ServerTimestamp or firestore.Increment(n), which
+// are interpreted by Firestore rather than stored.
+func isFirestoreSentinel(v interface{}) bool {
+	t := reflect.TypeOf(v)
+	return t.PkgPath() == firestorePkgPath && t.Kind() != reflect.Pointer
+}
+
+var firestorePkgPath = reflect.TypeOf(firestore.Update{}).PkgPath()
+
+// modelUpdates is encoder.modelUpdates without a client.
+func modelUpdates(m ReadableModel, updates []Update) ([]firestore.Update, error) {
+	return (&encoder{}).modelUpdates(m, updates)
+}
+
+// modelUpdates converts calcifer Updates on the model type of m into Firestore Updates.
+func (enc *encoder) modelUpdates(m ReadableModel, updates []Update) ([]firestore.Update, error) {
+	t := reflect.TypeOf(m)
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if _, err := defaultFieldCache.fields(t); err != nil {
+		return nil, err
+	}
+	fus := make([]firestore.Update, 0, len(updates))
+	c := &checker{}
+	for _, u := range updates {
+		fp, target, err := resolvePath(t, u.Path)
+		if err != nil {
+			return nil, err
+		}
+		if target.field != nil && target.field.TagOptions.computed {
+			return nil, fmt.Errorf("calcifer: cannot update computed field %q", u.Path)
+		}
+		if target.field != nil && target.field.TagOptions.readonly {
+			return nil, fmt.Errorf("calcifer: cannot update readonly field %q", u.Path)
+		}
+		c.update(target, u.Path, u.Value)
+		val, err := enc.encodeUpdateValue(target, u.Path, u.Value)
+		if err != nil {
+			return nil, err
+		}
+		// A nested struct with readonly fields is updated field by field.
+		if st := target.readonlyStruct(); st != nil {
+			sub, ok := val.(map[string]interface{})
+			if val == nil || val == firestore.Delete {
+				sub, ok = map[string]interface{}{}, true
+			}
+			if !ok {
+				return nil, fmt.Errorf("calcifer: cannot update field %q, which has readonly fields, with %v", u.Path, u.Value)
+			}
+			var leaves []firestore.FieldPath
+			overwritePaths(st, sub, nil, &leaves)
+			for _, l := range leaves {
+				fus = append(fus, firestore.Update{FieldPath: append(fp[:len(fp):len(fp)], l...), Value: leafValue(sub, l)})
+			}
+			continue
+		}
+		fus = append(fus, firestore.Update{FieldPath: fp, Value: val})
+	}
+	if err := c.result(); err != nil {
+		return nil, err
+	}
+	return fus, nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2022 Radiopaper Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calcifer
+
+import (
+	"testing"
+
+	"cloud.google.com/go/firestore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModelUpdates(t *testing.T) {
+	type address struct {
+		City string `calcifer:"city"`
+		Zip  string `calcifer:"zip"`
+	}
+	type testModel struct {
+		Model
+		Name    string            `calcifer:"name"`
+		Address address           `calcifer:"address"`
+		Tags    map[string]string `calcifer:"tags"`
+	}
+
+	fu, err := modelUpdates(testModel{}, []Update{
+		{Path: "name", Value: "Dave"},
+		{Path: "address.city", Value: "Hobbiton"},
+		{Path: "address", Value: address{City: "Bree", Zip: "1"}},
+		{Path: "tags.color", Value: "green"},
+		{Path: "name", Value: firestore.Delete},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []firestore.Update{
+		{FieldPath: []string{"name"}, Value: "Dave"},
+		{FieldPath: []string{"address", "city"}, Value: "Hobbiton"},
+		{FieldPath: []string{"address"}, Value: map[string]interface{}{"city": "Bree", "zip": "1"}},
+		{FieldPath: []string{"tags", "color"}, Value: "green"},
+		{FieldPath: []string{"name"}, Value: firestore.Delete},
+	}, fu)
+
+	_, err = modelUpdates(testModel{}, []Update{{Path: "nickname", Value: "Dave"}})
+	assert.Error(t, err)
+	_, err = modelUpdates(testModel{}, []Update{{Path: "address.country", Value: "Shire"}})
+	assert.Error(t, err)
+	_, err = modelUpdates(testModel{}, []Update{{Path: "name.first", Value: "Dave"}})
+	assert.Error(t, err)
+	_, err = modelUpdates(testModel{}, []Update{{Path: "name", Value: 7}})
+	assert.Error(t, err)
+
+	// Numbers are converted to the type of their field if no information is lost.
+	type counters struct {
+		Model
+		Count int64   `calcifer:"count"`
+		Ratio float64 `calcifer:"ratio"`
+		Small int8    `calcifer:"small"`
+	}
+	fu, err = modelUpdates(counters{}, []Update{
+		{Path: "count", Value: 3},
+		{Path: "ratio", Value: 2},
+		{Path: "small", Value: 4.0},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []firestore.Update{
+		{FieldPath: []string{"count"}, Value: int64(3)},
+		{FieldPath: []string{"ratio"}, Value: float64(2)},
+		{FieldPath: []string{"small"}, Value: int64(4)},
+	}, fu)
+	_, err = modelUpdates(counters{}, []Update{{Path: "count", Value: 1.5}})
+	assert.Error(t, err)
+	_, err = modelUpdates(counters{}, []Update{{Path: "small", Value: 300}})
+	assert.Error(t, err)
+	_, err = modelUpdates(counters{}, []Update{{Path: "ratio", Value: int64(1<<53 + 1)}})
+	assert.Error(t, err)
+}
+
+func TestModelUpdatesForeignKeys(t *testing.T) {
+	type relatedModel struct {
+		Model
+		X int `calcifer:"x"`
+	}
+	type testModel struct {
+		Model
+		RelPtr   *relatedModel           `calcifer:"relptr,ref:foo"`
+		RelSlice []relatedModel          `calcifer:"relslice,ref:foo"`
+		RelMap   map[string]relatedModel `calcifer:"relmap,ref:foo"`
+	}
+
+	fu, err := modelUpdates(&testModel{}, []Update{
+		{Path: "relptr", Value: &relatedModel{Model: Model{ID: "3"}}},
+		{Path: "relptr", Value: "3"},
+		{Path: "relslice", Value: []relatedModel{{Model: Model{ID: "4"}}, {Model: Model{ID: "5"}}}},
+		{Path: "relmap.six", Value: relatedModel{Model: Model{ID: "6"}}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []firestore.Update{
+		{FieldPath: []string{"relptr"}, Value: "3"},
+		{FieldPath: []string{"relptr"}, Value: "3"},
+		{FieldPath: []string{"relslice"}, Value: []string{"4", "5"}},
+		{FieldPath: []string{"relmap", "six"}, Value: "6"},
+	}, fu)
+
+	_, err = modelUpdates(testModel{}, []Update{{Path: "relptr.x", Value: 1}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,246 @@
+// Copyright 2022 Radiopaper Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calcifer
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+var typeOfModel = reflect.TypeOf(Model{})
+
+// validate checks that values of the struct type t can be stored in Firestore and
+// read back. It returns a *ModelTypeError listing every problem it finds in the
+// fields of t, of the structs nested in t, and of the models that t refers to.
+func validate(t reflect.Type) error {
+	v := &validator{visiting: map[reflect.Type]bool{}}
+	v.structType(t, "")
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return &ModelTypeError{Type: t, Problems: v.problems}
+}
+
+type validator struct {
+	problems []*FieldTypeError
+	visiting map[reflect.Type]bool // struct types being validated, to stop at cycles
+	inArray  bool                  // whether the value being validated is stored in an array
+}
+
+func (v *validator) add(path string, format string, args ...interface{}) {
+	v.problems = append(v.problems, &FieldTypeError{Path: path, err: fmt.Errorf(format, args...)})
+}
+
+// structType validates the fields of the struct type t, whose Go path is
+// prefixed to theirs.
+func (v *validator) structType(t reflect.Type, prefix string) {
+	if v.visiting[t] {
+		return
+	}
+	v.visiting[t] = true
+	defer delete(v.visiting, t)
+
+	fields := scanFields(t, func(index []int, err error) {
+		v.add(prefix+goFieldPath(t, index), "%v", err)
+	})
+	paths := make([]string, len(fields))
+	names := make(map[string]string, len(fields)) // from field names and aliases to Go paths
+	remain := ""
+	for i, f := range fields {
+		paths[i] = prefix + goFieldPath(t, f.Index)
+		if f.TagOptions.remain {
+			if remain != "" {
+				v.add(paths[i], "multiple remain fields (also %s)", remain)
+			}
+			if f.Type != typeOfMapStringInterface {
+				v.add(paths[i], "remain field must be of type map[string]interface{}, not %s", f.Type)
+			}
+			remain = paths[i]
+			continue
+		}
+		if other, ok := names[f.Name]; ok {
+			v.add(paths[i], "duplicate field name %q (also %s)", f.Name, other)
+		}
+		names[f.Name] = paths[i]
+	}
+	for i, f := range fields {
+		for _, a := range f.TagOptions.aliases {
+			if other, ok := names[a]; ok {
+				v.add(paths[i], "alias %q is already the name or alias of %s", a, other)
+			}
+			names[a] = paths[i]
+		}
+	}
+	for i, f := range fields {
+		if f.TagOptions.remain {
+			continue
+		}
+		if f.TagOptions.serverTimestamp && f.Type != typeOfGoTime {
+			v.add(paths[i], "serverTimestamp field must be of type time.Time, not %s", f.Type)
+		}
+		if f.TagOptions.serverTimestamp && v.inArray {
+			v.add(paths[i], "serverTimestamp field cannot be in a slice, as Firestore does not allow server timestamps in arrays")
+		}
+		if f.TagOptions.refAs != refByID && f.TagOptions.reference == "" {
+			v.add(paths[i], "as tag option requires a ref tag option")
+		}
+		if f.TagOptions.hasOnMissing && f.TagOptions.reference == "" {
+			v.add(paths[i], "onmissing tag option requires a ref tag option")
+		}
+		if f.TagOptions.readonly && (f.TagOptions.writeonly || f.TagOptions.computed || f.TagOptions.serverTimestamp) {
+			v.add(paths[i], "readonly field cannot be writeonly, computed or a serverTimestamp")
+		}
+		if f.TagOptions.computed {
+			if f.TagOptions.reference != "" || f.TagOptions.serverTimestamp {
+				v.add(paths[i], "computed field cannot be a reference or a serverTimestamp")
+			} else if _, err := computeMethod(t, f); err != nil {
+				v.add(paths[i], "%v", err)
+			}
+		}
+		v.constraintTypes(f, paths[i])
+		if f.TagOptions.reference != "" {
+			v.referenceType(f.Type, paths[i])
+		} else {
+			v.valueType(f.Type, paths[i])
+		}
+	}
+}
+
+// valueType validates the type t of a field that is not a reference.
+func (v *validator) valueType(t reflect.Type, path string) {
+	switch t {
+	case typeOfGoTime, typeOfByteSlice, typeOfLatLng, typeOfProtoTimestamp, typeOfFirestoreDocRef, typeOfDocRef:
+		return
+	}
+	if t.Kind() != reflect.Pointer && t.Kind() != reflect.Interface && hasMarshalOrUnmarshalMethod(t) {
+		return
+	}
+	switch t.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+	case reflect.Pointer:
+		v.valueType(t.Elem(), path)
+	case reflect.Slice:
+		inArray := v.inArray
+		v.inArray = true
+		v.valueType(t.Elem(), path)
+		v.inArray = inArray
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			v.add(path, "map key type %s is not a string type", t.Key())
+		}
+		v.valueType(t.Elem(), path)
+	case reflect.Struct:
+		if isLeafType(t) {
+			v.add(path, "type %s must be used by pointer", t)
+			return
+		}
+		v.structType(t, path+".")
+	case reflect.Interface:
+		if t.NumMethod() != 0 {
+			v.add(path, "unsupported interface type %s", t)
+		}
+	default:
+		v.add(path, "unsupported type %s", t)
+	}
+}
+
+// referenceType validates the type t of a field tagged with "ref:". A single
+// reference must be a pointer to a model; several references are a slice or a
+// string-keyed map of models or pointers to models.
+func (v *validator) referenceType(t reflect.Type, path string) {
+	var mt reflect.Type
+	switch t.Kind() {
+	case reflect.Pointer:
+		mt = t.Elem()
+	case reflect.Struct:
+		v.add(path, "reference to a single model must be a pointer, not %s", t)
+		return
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			v.add(path, "map key type %s is not a string type", t.Key())
+		}
+		fallthrough
+	case reflect.Slice:
+		mt = t.Elem()
+		if mt.Kind() == reflect.Pointer {
+			mt = mt.Elem()
+		}
+	default:
+		v.add(path, "reference must be a pointer, slice or map of models, not %s", t)
+		return
+	}
+	if !isModelType(mt) {
+		v.add(path, "referenced type %s does not embed calcifer.Model", mt)
+		return
+	}
+	// Referenced models are stored in documents of their own.
+	inArray := v.inArray
+	v.inArray = false
+	v.structType(mt, path+".")
+	v.inArray = inArray
+}
+
+// constraintTypes checks that the constraints on field f apply to its type.
+func (v *validator) constraintTypes(f field, path string) {
+	cs := f.TagOptions.constraints
+	t := f.Type
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if f.TagOptions.reference != "" {
+		if cs.min != nil || cs.max != nil || cs.oneOf != nil || (cs.maxLen != nil && t.Kind() == reflect.Struct) {
+			v.add(path, "only required and maxlen constraints apply to references")
+		}
+		return
+	}
+	integer := false
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		integer = true
+	}
+	if (cs.min != nil || cs.max != nil) && !integer && t.Kind() != reflect.Float32 && t.Kind() != reflect.Float64 {
+		v.add(path, "min and max constraints apply to numbers, not %s", f.Type)
+	}
+	if cs.maxLen != nil && t.Kind() != reflect.String && t.Kind() != reflect.Slice && t.Kind() != reflect.Map {
+		v.add(path, "maxlen constraint applies to strings, slices and maps, not %s", f.Type)
+	}
+	if cs.oneOf != nil {
+		switch {
+		case t.Kind() == reflect.String:
+		case integer:
+			for _, o := range cs.oneOf {
+				if _, err := strconv.ParseInt(o, 10, 64); err != nil {
+					v.add(path, "oneof value %q is not an integer", o)
+				}
+			}
+		default:
+			v.add(path, "oneof constraint applies to strings and integers, not %s", f.Type)
+		}
+	}
+}
+
+// isModelType reports whether t is a struct type that embeds Model.
+func isModelType(t reflect.Type) bool {
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+	f, ok := t.FieldByName("Model")
+	return ok && f.Anonymous && f.Type == typeOfModel
+}